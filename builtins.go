@@ -0,0 +1,116 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"mvdan.cc/sh/v3/interp"
+)
+
+// builtin runs a command that goreduce provides to the shell programs run
+// by the embedded interpreter, to keep the common ones short and portable.
+// It reports false if args is not a builtin.
+func (r *reducer) builtin(ctx context.Context, mc interp.ModuleCtx, args []string, stdout, stderr io.Writer) (bool, error) {
+	switch args[0] {
+	case "goreduce_build":
+		return true, r.buildBuiltin(ctx, mc, args, stdout, stderr)
+	case "goreduce_timeout":
+		return true, r.timeoutBuiltin(ctx, mc, args, stdout, stderr)
+	case "goreduce_expect":
+		return true, r.expectBuiltin(ctx, mc, args, stdout, stderr)
+	case "goreduce_cmp":
+		return true, r.cmpBuiltin(ctx, mc, args, stdout, stderr)
+	}
+	return false, nil
+}
+
+// buildBuiltin implements "goreduce_build [flags]", which builds the package
+// into ./out with the toolchain in use.
+func (r *reducer) buildBuiltin(ctx context.Context, mc interp.ModuleCtx, args []string, stdout, stderr io.Writer) error {
+	argv := append([]string{"go", "build", "-o", "out"}, args[1:]...)
+	return r.exec(ctx, mc, "", argv, stdout, stderr)
+}
+
+// timeoutBuiltin implements "goreduce_timeout duration cmd [args]", which
+// runs a command, killing it and failing with status 124 if it takes longer
+// than the duration.
+func (r *reducer) timeoutBuiltin(ctx context.Context, mc interp.ModuleCtx, args []string, stdout, stderr io.Writer) error {
+	if len(args) < 3 {
+		fmt.Fprintf(stderr, "usage: goreduce_timeout duration cmd [args]\n")
+		return interp.ExitStatus(2)
+	}
+	d, err := time.ParseDuration(args[1])
+	if err != nil {
+		fmt.Fprintf(stderr, "goreduce_timeout: %v\n", err)
+		return interp.ExitStatus(2)
+	}
+	tctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	err = r.exec(tctx, mc, "", args[2:], stdout, stderr)
+	if tctx.Err() != nil && ctx.Err() == nil {
+		fmt.Fprintf(stderr, "goreduce_timeout: %s timed out after %v\n", args[2], d)
+		return interp.ExitStatus(124)
+	}
+	return err
+}
+
+// expectBuiltin implements "goreduce_expect regexp cmd [args]", which runs a
+// command and only succeeds if its output matches the regexp. The output is
+// kept as well.
+func (r *reducer) expectBuiltin(ctx context.Context, mc interp.ModuleCtx, args []string, stdout, stderr io.Writer) error {
+	if len(args) < 3 {
+		fmt.Fprintf(stderr, "usage: goreduce_expect regexp cmd [args]\n")
+		return interp.ExitStatus(2)
+	}
+	rx, err := regexp.Compile(args[1])
+	if err != nil {
+		fmt.Fprintf(stderr, "goreduce_expect: %v\n", err)
+		return interp.ExitStatus(2)
+	}
+	var out bytes.Buffer
+	err = r.exec(ctx, mc, "", args[2:], io.MultiWriter(stdout, &out), io.MultiWriter(stderr, &out))
+	if ctx.Err() != nil {
+		return err
+	}
+	if !rx.Match(out.Bytes()) {
+		fmt.Fprintf(stderr, "goreduce_expect: output of %s does not match %q\n", args[2], args[1])
+		return interp.ExitStatus(1)
+	}
+	return nil
+}
+
+// cmpBuiltin implements "goreduce_cmp file1 file2", which succeeds only if
+// both files are equal, such as the outputs of two builds. Like cmp, it fails
+// with status 1 if they differ and 2 if either cannot be read.
+func (r *reducer) cmpBuiltin(ctx context.Context, mc interp.ModuleCtx, args []string, stdout, stderr io.Writer) error {
+	if len(args) != 3 {
+		fmt.Fprintf(stderr, "usage: goreduce_cmp file1 file2\n")
+		return interp.ExitStatus(2)
+	}
+	var conts [2][]byte
+	for i, name := range args[1:] {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(mc.Dir, name)
+		}
+		cont, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "goreduce_cmp: %v\n", err)
+			return interp.ExitStatus(2)
+		}
+		conts[i] = cont
+	}
+	if !bytes.Equal(conts[0], conts[1]) {
+		fmt.Fprintf(stderr, "goreduce_cmp: %s and %s differ\n", args[1], args[2])
+		return interp.ExitStatus(1)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"go/ast"
+	"sort"
+	"strings"
+)
+
+// keepComment reports whether a comment must survive stripping, as it is
+// read by the toolchain. This includes directives like //go:noinline, build
+// constraints, and //export and //line comments.
+func keepComment(c *ast.Comment) bool {
+	if isDirective(c) {
+		return true
+	}
+	for _, prefix := range [...]string{"// +build", "//export ", "//line ", "/*line "} {
+		if strings.HasPrefix(c.Text, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripComments tries to remove the ordinary comments of each file, leaving
+// only the ones that the toolchain reads. If a file's comments cannot all go
+// at once, such as when a test checks an Output comment, each comment group
+// is tried on its own.
+func (r *reducer) stripComments() (anyChanges bool) {
+	for _, file := range r.allFiles() {
+		r.file = file
+		preamble := cgoPreamble(file)
+		var groups []*ast.CommentGroup
+		for _, cg := range file.Comments {
+			if cg == preamble {
+				continue
+			}
+			for _, c := range cg.List {
+				if !keepComment(c) {
+					groups = append(groups, cg)
+					break
+				}
+			}
+		}
+		if len(groups) == 0 {
+			continue
+		}
+		if r.stripGroups(groups) {
+			r.logChange(file, "removed comments")
+			anyChanges = true
+			continue
+		}
+		removed := 0
+		for _, cg := range groups {
+			if r.stripGroups([]*ast.CommentGroup{cg}) {
+				removed++
+			}
+		}
+		if removed > 0 {
+			r.logChange(file, "removed %d comment groups", removed)
+			anyChanges = true
+		}
+	}
+	r.didChange = false
+	return anyChanges
+}
+
+// stripGroups removes the ordinary comments from the given groups of r.file,
+// keeping the program if it is still interesting. The lines left empty are
+// merged, so that no blank lines are left in place of the comments.
+func (r *reducer) stripGroups(groups []*ast.CommentGroup) bool {
+	file := r.file
+	origComments := file.Comments
+	origLists := make([][]*ast.Comment, len(groups))
+	strip := make(map[*ast.CommentGroup]bool, len(groups))
+	var removed []*ast.Comment
+	for i, cg := range groups {
+		origLists[i] = cg.List
+		strip[cg] = true
+		var list []*ast.Comment
+		for _, c := range cg.List {
+			if keepComment(c) {
+				list = append(list, c)
+			} else {
+				removed = append(removed, c)
+			}
+		}
+		cg.List = list
+	}
+	var comments []*ast.CommentGroup
+	for _, cg := range origComments {
+		if !strip[cg] || len(cg.List) > 0 {
+			comments = append(comments, cg)
+		}
+	}
+	file.Comments = comments
+	r.didChange = false
+	if !r.okChange() {
+		file.Comments = origComments
+		for i, cg := range groups {
+			cg.List = origLists[i]
+		}
+		return false
+	}
+	r.mergeCommentLines(removed)
+	clearEmptyDocs(file)
+	return true
+}
+
+// clearEmptyDocs drops the references to comment groups left empty, so that
+// they are not mistaken for doc comments.
+func clearEmptyDocs(file *ast.File) {
+	drop := func(cg **ast.CommentGroup) {
+		if *cg != nil && len((*cg).List) == 0 {
+			*cg = nil
+		}
+	}
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch x := node.(type) {
+		case *ast.File:
+			drop(&x.Doc)
+		case *ast.GenDecl:
+			drop(&x.Doc)
+		case *ast.FuncDecl:
+			drop(&x.Doc)
+		case *ast.Field:
+			drop(&x.Doc)
+			drop(&x.Comment)
+		case *ast.ImportSpec:
+			drop(&x.Doc)
+			drop(&x.Comment)
+		case *ast.ValueSpec:
+			drop(&x.Doc)
+			drop(&x.Comment)
+		case *ast.TypeSpec:
+			drop(&x.Doc)
+			drop(&x.Comment)
+		case *ast.CommentGroup:
+			return false
+		}
+		return true
+	})
+}
+
+// mergeCommentLines merges the lines that the removed comments were alone on
+// into the lines before them.
+func (r *reducer) mergeCommentLines(removed []*ast.Comment) {
+	tfile := r.fset.File(r.file.Pos())
+	// lines holding tokens or remaining comments
+	used := make(map[int]bool)
+	ast.Inspect(r.file, func(node ast.Node) bool {
+		switch node.(type) {
+		case nil, *ast.Comment, *ast.CommentGroup:
+			return false
+		}
+		used[tfile.Line(node.Pos())] = true
+		used[tfile.Line(node.End()-1)] = true
+		return true
+	})
+	for _, cg := range r.file.Comments {
+		for _, c := range cg.List {
+			used[tfile.Line(c.Pos())] = true
+		}
+	}
+	var lines []int
+	for _, c := range removed {
+		start, end := tfile.Line(c.Pos()), tfile.Line(c.End())
+		if used[start] || used[end] {
+			continue // shares a line with code or another comment
+		}
+		for l := start; l <= end; l++ {
+			used[l] = true
+			lines = append(lines, l)
+		}
+	}
+	// merge from the bottom, so that the line numbers above stay valid
+	sort.Sort(sort.Reverse(sort.IntSlice(lines)))
+	for _, l := range lines {
+		if l > 1 {
+			tfile.MergeLine(l - 1)
+		} else if tfile.LineCount() > 1 {
+			tfile.MergeLine(l)
+		}
+	}
+}
@@ -0,0 +1,580 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// localPkg is a package of the module that the package being reduced imports,
+// directly or not. Its declarations can be inlined into the package. With
+// -deps, third-party packages copied into the workspace are included too.
+type localPkg struct {
+	bp    *build.Package
+	files []*ast.File
+
+	info *types.Info
+	tpkg *types.Package
+
+	mod *depModule // third-party module, if not of our module
+
+	inlined bool
+}
+
+// localDeps returns the packages of the module that bp imports, including
+// from its tests and through other packages of the module. They are sorted
+// by import path.
+func localDeps(bctx build.Context, mod module, bp *build.Package, impPath string) ([]*build.Package, error) {
+	var queue []string
+	queue = append(queue, bp.Imports...)
+	queue = append(queue, bp.TestImports...)
+	queue = append(queue, bp.XTestImports...)
+	absDir, err := filepath.Abs(bp.Dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{impPath: true}
+	var deps []*build.Package
+	for len(queue) > 0 {
+		imp := queue[0]
+		queue = queue[1:]
+		if seen[imp] {
+			continue
+		}
+		seen[imp] = true
+		dir, ok := mod.pkgDir(imp)
+		if !ok {
+			continue
+		}
+		dep, err := bctx.ImportDir(dir, 0)
+		if err != nil {
+			return nil, err
+		}
+		dep.ImportPath = imp
+		// keep the paths relative like the package's own, for the logs
+		if rel, err := filepath.Rel(absDir, dir); err == nil {
+			dep.Dir = filepath.Join(bp.Dir, rel)
+		}
+		deps = append(deps, dep)
+		queue = append(queue, dep.Imports...)
+	}
+	sort.Slice(deps, func(i, j int) bool {
+		return deps[i].ImportPath < deps[j].ImportPath
+	})
+	return deps, nil
+}
+
+// parseDeps parses the non-test Go files of each local package.
+func parseDeps(fset *token.FileSet, deps []*build.Package, mode parser.Mode) ([][]*ast.File, error) {
+	all := make([][]*ast.File, len(deps))
+	for i, bp := range deps {
+		for _, list := range [...][]string{bp.GoFiles, bp.CgoFiles} {
+			for _, name := range list {
+				f, err := parser.ParseFile(fset, filepath.Join(bp.Dir, name), nil, mode)
+				if err != nil {
+					return nil, err
+				}
+				all[i] = append(all[i], f)
+			}
+		}
+	}
+	return all, nil
+}
+
+// depImporter wraps an importer so that the local packages are type-checked
+// from source, as the importer may not be able to find them.
+func (r *reducer) depImporter(imp types.Importer) types.Importer {
+	return importerFunc(func(path string) (*types.Package, error) {
+		dep := r.deps[path]
+		if dep == nil {
+			return imp.Import(path)
+		}
+		r.checkDep(dep)
+		if dep.tpkg == nil {
+			return nil, fmt.Errorf("import cycle through %s", path)
+		}
+		return dep.tpkg, nil
+	})
+}
+
+// checkDep type-checks a local package, if it wasn't already.
+func (r *reducer) checkDep(dep *localPkg) {
+	if dep.info != nil {
+		return
+	}
+	dep.info = &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	dep.tpkg, _ = r.tconf.Check(dep.bp.ImportPath, r.fset, dep.files, dep.info)
+}
+
+// depDecl is a declaration of a local package, which is copied as a whole.
+// Specs of var and type declarations are copied on their own, but constant
+// declarations are kept together as they may rely on iota.
+type depDecl struct {
+	decl ast.Decl
+	doc  *ast.CommentGroup
+	objs []types.Object
+}
+
+// depDecls splits the declarations of a local package into units to copy.
+// The units that are always needed, such as init funcs, are returned too.
+func depDecls(dep *localPkg) (decls []*depDecl, roots []int, methods map[types.Object][]int) {
+	methods = make(map[types.Object][]int)
+	add := func(d *depDecl) int {
+		decls = append(decls, d)
+		return len(decls) - 1
+	}
+	for _, file := range dep.files {
+		for _, decl := range file.Decls {
+			switch x := decl.(type) {
+			case *ast.FuncDecl:
+				i := add(&depDecl{decl: x, doc: x.Doc})
+				if x.Recv != nil {
+					if base := recvBase(x.Recv.List[0].Type); base != nil {
+						tobj := dep.info.Uses[base]
+						methods[tobj] = append(methods[tobj], i)
+					}
+					continue
+				}
+				if x.Name.Name == "init" {
+					roots = append(roots, i)
+					continue
+				}
+				decls[i].objs = []types.Object{dep.info.Defs[x.Name]}
+			case *ast.GenDecl:
+				switch x.Tok {
+				case token.IMPORT:
+					continue
+				case token.CONST:
+					d := &depDecl{decl: x, doc: x.Doc}
+					for _, spec := range x.Specs {
+						for _, name := range spec.(*ast.ValueSpec).Names {
+							d.objs = append(d.objs, dep.info.Defs[name])
+						}
+					}
+					add(d)
+					continue
+				}
+				for _, spec := range x.Specs {
+					gd := &ast.GenDecl{TokPos: spec.Pos(), Tok: x.Tok, Specs: []ast.Spec{spec}}
+					d := &depDecl{decl: gd}
+					if !x.Lparen.IsValid() {
+						gd.TokPos = x.TokPos
+						d.doc = x.Doc
+					}
+					blank := true
+					switch spec := spec.(type) {
+					case *ast.ValueSpec:
+						d.doc = firstDoc(spec.Doc, d.doc)
+						for _, name := range spec.Names {
+							d.objs = append(d.objs, dep.info.Defs[name])
+							blank = blank && name.Name == "_"
+						}
+					case *ast.TypeSpec:
+						d.doc = firstDoc(spec.Doc, d.doc)
+						d.objs = append(d.objs, dep.info.Defs[spec.Name])
+						blank = false
+					}
+					i := add(d)
+					if blank { // var _ = f()
+						roots = append(roots, i)
+					}
+				}
+			}
+		}
+	}
+	return decls, roots, methods
+}
+
+func firstDoc(docs ...*ast.CommentGroup) *ast.CommentGroup {
+	for _, doc := range docs {
+		if doc != nil {
+			return doc
+		}
+	}
+	return nil
+}
+
+// recvBase returns the name of a method receiver's type.
+func recvBase(expr ast.Expr) *ast.Ident {
+	switch x := expr.(type) {
+	case *ast.Ident:
+		return x
+	case *ast.StarExpr:
+		return recvBase(x.X)
+	case *ast.ParenExpr:
+		return recvBase(x.X)
+	case *ast.IndexExpr:
+		return recvBase(x.X)
+	case *ast.IndexListExpr:
+		return recvBase(x.X)
+	}
+	return nil
+}
+
+// importName returns the name that an import is used with in its file.
+func (r *reducer) importName(imp *ast.ImportSpec) string {
+	if imp.Name != nil {
+		return imp.Name.Name
+	}
+	if pkgName, _ := r.info.Implicits[imp].(*types.PkgName); pkgName != nil {
+		return pkgName.Name()
+	}
+	unq, _ := strconv.Unquote(imp.Path.Value)
+	return path.Base(unq)
+}
+
+// fileImports returns the import specs of a file. Unlike the file's Imports
+// field, it follows the changes made to its declarations.
+func fileImports(file *ast.File) []*ast.ImportSpec {
+	var imps []*ast.ImportSpec
+	for _, decl := range file.Decls {
+		if gd, _ := decl.(*ast.GenDecl); gd != nil && gd.Tok == token.IMPORT {
+			for _, spec := range gd.Specs {
+				imps = append(imps, spec.(*ast.ImportSpec))
+			}
+		}
+	}
+	return imps
+}
+
+func importPath(imp *ast.ImportSpec) string {
+	unq, _ := strconv.Unquote(imp.Path.Value)
+	return unq
+}
+
+// inlinePkg tries to replace the import of a local package by copies of the
+// declarations that our package needs from it. Declared names that would
+// clash are renamed, and the selectors like pkg.Name are replaced by the
+// copied names.
+func (r *reducer) inlinePkg(spec *ast.ImportSpec) bool {
+	imPath, _ := strconv.Unquote(spec.Path.Value)
+	dep := r.deps[imPath]
+	if dep == nil || dep.inlined || (spec.Name != nil && spec.Name.Name == ".") {
+		return false
+	}
+	r.checkDep(dep)
+	if dep.tpkg == nil {
+		return false
+	}
+	scope := dep.tpkg.Scope()
+	files := r.files
+	for _, file := range r.xfiles {
+		if file == r.file {
+			files = r.xfiles
+		}
+	}
+
+	// Find the uses of the package, and the names that copies must avoid.
+	var specs []*ast.ImportSpec
+	var sels []*ast.SelectorExpr
+	touched := []*ast.File{r.file} // the files to write and check
+	taken := make(map[string]bool)
+	fileNames := make(map[string]string)
+	for _, file := range files {
+		for _, imp := range fileImports(file) {
+			name := r.importName(imp)
+			if unq, _ := strconv.Unquote(imp.Path.Value); unq != imPath {
+				taken[name] = true
+				if file == r.file {
+					fileNames[name] = unq
+				}
+				continue
+			}
+			switch name {
+			case "_":
+				continue
+			case ".":
+				return false
+			}
+			specs = append(specs, imp)
+			if file != r.file {
+				touched = append(touched, file)
+			}
+			ast.Inspect(file, func(node ast.Node) bool {
+				sel, _ := node.(*ast.SelectorExpr)
+				if sel == nil {
+					return true
+				}
+				id, _ := sel.X.(*ast.Ident)
+				if id == nil || id.Name != name {
+					return true
+				}
+				switch obj := r.info.Uses[id].(type) {
+				case nil:
+					if id.Obj != nil {
+						return true
+					}
+				case *types.PkgName:
+					if obj.Imported().Path() != imPath {
+						return true
+					}
+				default:
+					return true
+				}
+				sels = append(sels, sel)
+				return false
+			})
+		}
+		for _, name := range topLevelNames(file) {
+			taken[name] = true
+		}
+	}
+
+	// Gather the declarations that the uses need, and their imports.
+	decls, roots, methods := depDecls(dep)
+	declOf := make(map[types.Object]int)
+	for i, d := range decls {
+		for _, obj := range d.objs {
+			declOf[obj] = i
+		}
+	}
+	copied := make(map[int]bool)
+	var queue []int
+	need := func(i int) {
+		if !copied[i] {
+			copied[i] = true
+			queue = append(queue, i)
+		}
+	}
+	for _, i := range roots {
+		need(i)
+	}
+	for _, sel := range sels {
+		obj := scope.Lookup(sel.Sel.Name)
+		i, ok := declOf[obj]
+		if !ok {
+			return false
+		}
+		need(i)
+	}
+	imports := make(map[string]string) // name to path
+	for len(queue) > 0 {
+		d := decls[queue[0]]
+		queue = queue[1:]
+		conflict := false
+		ast.Inspect(d.decl, func(node ast.Node) bool {
+			id, _ := node.(*ast.Ident)
+			if id == nil {
+				return true
+			}
+			switch obj := dep.info.Uses[id].(type) {
+			case *types.PkgName:
+				p := obj.Imported().Path()
+				if prev, ok := imports[id.Name]; (ok && prev != p) || p == "C" {
+					conflict = true
+				}
+				imports[id.Name] = p
+			case nil:
+			default:
+				if obj.Parent() == scope {
+					if i, ok := declOf[obj]; ok {
+						need(i)
+					}
+				}
+			}
+			return true
+		})
+		if conflict {
+			return false
+		}
+		for _, obj := range d.objs {
+			for _, i := range methods[obj] {
+				need(i)
+			}
+		}
+	}
+	var list []int
+	for i := range copied {
+		list = append(list, i)
+	}
+	sort.Ints(list)
+
+	// Pick the new names, avoiding the names taken in our package.
+	renames := make(map[types.Object]string)
+	for _, i := range list {
+		for _, obj := range decls[i].objs {
+			if obj == nil || obj.Name() == "_" {
+				continue
+			}
+			name := obj.Name()
+			if taken[name] {
+				name = uniqueName(taken, dep.tpkg.Name()+upperFirst(name))
+				renames[obj] = name
+			}
+			taken[name] = true
+		}
+	}
+	var newImps []ast.Spec
+	var impNames []string
+	for name := range imports {
+		impNames = append(impNames, name)
+	}
+	sort.Strings(impNames)
+	for _, name := range impNames {
+		p := imports[name]
+		if prev, ok := fileNames[name]; ok {
+			if prev != p {
+				return false
+			}
+			continue
+		}
+		if taken[name] {
+			return false
+		}
+		imp := &ast.ImportSpec{Path: &ast.BasicLit{
+			ValuePos: spec.Path.Pos(),
+			Kind:     token.STRING,
+			Value:    strconv.Quote(p),
+		}}
+		if name != path.Base(p) {
+			imp.Name = &ast.Ident{NamePos: spec.Pos(), Name: name}
+		}
+		newImps = append(newImps, imp)
+	}
+
+	// Apply the changes, keeping what is needed to undo them.
+	var undos []func()
+	undo := func() {
+		for i := len(undos) - 1; i >= 0; i-- {
+			undos[i]()
+		}
+	}
+	// Copy the declarations and their docs, as the package's own must be
+	// left as they are, and rename the copies.
+	copies := make(map[interface{}]interface{})
+	var newDecls []ast.Decl
+	var newDocs []*ast.CommentGroup
+	for _, i := range list {
+		newDecls = append(newDecls, copyNode(decls[i].decl, nil, copies).(ast.Decl))
+		if doc := decls[i].doc; doc != nil {
+			newDocs = append(newDocs, copyNode(doc, nil, copies).(*ast.CommentGroup))
+		}
+	}
+	for orig, cp := range copies {
+		id, _ := orig.(*ast.Ident)
+		if id == nil {
+			continue
+		}
+		obj := dep.info.Defs[id]
+		if obj == nil {
+			obj = dep.info.Uses[id]
+		}
+		if name, ok := renames[obj]; ok {
+			cp.(*ast.Ident).Name = name
+		}
+	}
+	for _, sel := range sels {
+		obj := scope.Lookup(sel.Sel.Name)
+		name := obj.Name()
+		if newName, ok := renames[obj]; ok {
+			name = newName
+		}
+		ref := r.exprRef(sel)
+		if ref == nil {
+			undo()
+			return false
+		}
+		sel := sel
+		*ref = &ast.Ident{NamePos: sel.Pos(), Name: name}
+		undos = append(undos, func() { *ref = sel })
+	}
+	gd := r.parents[spec].(*ast.GenDecl)
+	origSpecs, origLparen, origRparen := gd.Specs, gd.Lparen, gd.Rparen
+	origImports := r.file.Imports
+	for _, imp := range specs {
+		if imp == spec && len(newImps) > 0 {
+			continue
+		}
+		undos = append(undos, r.removeSpec(imp))
+	}
+	if len(newImps) > 0 {
+		var specs []ast.Spec
+		for _, sp := range gd.Specs {
+			if sp == spec {
+				specs = append(specs, newImps...)
+			} else {
+				specs = append(specs, sp)
+			}
+		}
+		gd.Specs = specs
+		if len(specs) > 1 && !gd.Lparen.IsValid() {
+			gd.Lparen, gd.Rparen = spec.Pos(), spec.End()
+		}
+		for _, imp := range newImps {
+			r.file.Imports = append(r.file.Imports, imp.(*ast.ImportSpec))
+		}
+	}
+	undos = append(undos, func() {
+		gd.Specs, gd.Lparen, gd.Rparen = origSpecs, origLparen, origRparen
+		r.file.Imports = origImports
+	})
+	origDecls, origComments := r.file.Decls, r.file.Comments
+	r.file.Decls = append(r.file.Decls[:len(origDecls):len(origDecls)], newDecls...)
+	r.file.Comments = append(r.file.Comments[:len(origComments):len(origComments)], newDocs...)
+	undos = append(undos, func() {
+		r.file.Decls, r.file.Comments = origDecls, origComments
+	})
+	if !r.okChangeFiles(touched...) {
+		undo()
+		return false
+	}
+	dep.inlined = true
+	r.fillParents()
+	return true
+}
+
+// topLevelNames returns the names declared at the package level by a file.
+func topLevelNames(file *ast.File) []string {
+	var names []string
+	for _, decl := range file.Decls {
+		switch x := decl.(type) {
+		case *ast.FuncDecl:
+			if x.Recv == nil && x.Name.Name != "init" {
+				names = append(names, x.Name.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range x.Specs {
+				switch spec := spec.(type) {
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						names = append(names, name.Name)
+					}
+				case *ast.TypeSpec:
+					names = append(names, spec.Name.Name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// uniqueName returns a name that is not taken, adding a number to base if
+// needed. The name is then marked as taken.
+func uniqueName(taken map[string]bool, base string) string {
+	name := base
+	for n := 2; taken[name]; n++ {
+		name = base + strconv.Itoa(n)
+	}
+	taken[name] = true
+	return name
+}
+
+func upperFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
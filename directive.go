@@ -0,0 +1,119 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"go/ast"
+	"strings"
+)
+
+// isDirective reports whether a comment is a directive like //go:embed,
+// which must stay right above the declaration it belongs to.
+func isDirective(c *ast.Comment) bool {
+	return strings.HasPrefix(c.Text, "//go:")
+}
+
+// directives returns the directives in a comment group with the given prefix,
+// such as "//go:embed".
+func directives(cg *ast.CommentGroup, prefix string) []*ast.Comment {
+	if cg == nil {
+		return nil
+	}
+	var list []*ast.Comment
+	for _, c := range cg.List {
+		if isDirective(c) && strings.HasPrefix(c.Text, prefix) {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// specDoc returns the doc comment of a spec, which is the one of its GenDecl
+// if the spec is not in parentheses.
+func (r *reducer) specDoc(spec ast.Spec) *ast.CommentGroup {
+	var doc *ast.CommentGroup
+	switch x := spec.(type) {
+	case *ast.ValueSpec:
+		doc = x.Doc
+	case *ast.TypeSpec:
+		doc = x.Doc
+	case *ast.ImportSpec:
+		doc = x.Doc
+	}
+	if gd, _ := r.parents[spec].(*ast.GenDecl); doc == nil && gd != nil && !gd.Lparen.IsValid() {
+		doc = gd.Doc
+	}
+	return doc
+}
+
+// removeComment removes a comment from its group. If the group is left
+// empty, the group is removed from the file instead, so that it is not
+// printed.
+func (r *reducer) removeComment(cg *ast.CommentGroup, c *ast.Comment) (undo func()) {
+	if len(cg.List) == 1 {
+		return r.removeDoc(cg)
+	}
+	orig := cg.List
+	for i, c2 := range orig {
+		if c2 == c {
+			cg.List = append(orig[:i:i], orig[i+1:]...)
+			break
+		}
+	}
+	return func() { cg.List = orig }
+}
+
+// removeDoc removes a comment group from the file, such as the doc comment of
+// a declaration being removed, so that it is not left behind.
+func (r *reducer) removeDoc(cg *ast.CommentGroup) (undo func()) {
+	return removeFileDoc(r.file, cg)
+}
+
+// removeFileDoc is like removeDoc, for a comment group in the given file.
+func removeFileDoc(file *ast.File, cg *ast.CommentGroup) (undo func()) {
+	orig := file.Comments
+	file.Comments = withoutGroup(orig, cg)
+	return func() { file.Comments = orig }
+}
+
+// withoutGroup returns a list of comment groups without cg, which may be nil.
+// The original list is not modified.
+func withoutGroup(list []*ast.CommentGroup, cg *ast.CommentGroup) []*ast.CommentGroup {
+	for i, cg2 := range list {
+		if cg != nil && cg2 == cg {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// directiveName returns the name of a directive, such as "go:noinline".
+func directiveName(c *ast.Comment) string {
+	name := strings.TrimPrefix(c.Text, "//")
+	if i := strings.IndexAny(name, " \t"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// removeDirectives tries to remove each of the directives in a doc comment,
+// such as //go:noinline or //go:embed, logging the ones that are removed.
+func (r *reducer) removeDirectives(doc *ast.CommentGroup) (anyChanges bool) {
+	for _, c := range directives(doc, "//go:") {
+		undo := r.removeComment(doc, c)
+		if !r.okChange() {
+			undo()
+			continue
+		}
+		r.logChange(c, "removed %s directive", directiveName(c))
+		// join the now empty line with the one before it, so that any
+		// directive following it stays at the start of its line
+		file := r.fset.File(c.Pos())
+		if line := file.Line(c.Pos()); line > 1 {
+			file.MergeLine(line - 1)
+		}
+		anyChanges = true
+	}
+	return anyChanges
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"go/token"
+	"strconv"
+	"time"
+)
+
+// event is a step of the reduction, written as a line of JSON with -json.
+type event struct {
+	Kind     string  `json:"kind"`              // "attempt" or "accept"
+	Rule     string  `json:"rule"`              // such as "ExprStmt" or "lines"
+	Pos      string  `json:"pos,omitempty"`     // position in the original files
+	Before   string  `json:"before,omitempty"`  // code or lines before an attempt
+	After    string  `json:"after,omitempty"`   // code or lines after an attempt
+	Message  string  `json:"message,omitempty"` // change made, for accepts
+	OK       bool    `json:"ok"`                // whether the program was interesting
+	Duration float64 `json:"duration"`          // seconds spent, since the last accept for accepts
+	Tries    int     `json:"tries"`             // tries since the last accept
+	Size     int     `json:"size"`              // bytes of the files being reduced
+}
+
+// maxSnippet is the length at which the before and after snippets are cut.
+const maxSnippet = 200
+
+// emit writes an event, if -json is set. Once writing one fails, the rest
+// are dropped and the reduction fails when it is done.
+func (r *reducer) emit(ev event) {
+	if r.events == nil || r.eventsErr != nil {
+		return
+	}
+	ev.Rule = r.rule
+	ev.Tries = r.tries
+	r.eventsErr = r.events.Encode(ev)
+}
+
+// attempt runs the command on a candidate program, given the contents of the
+// file that changed before and after. The change is at pos, if valid, or at
+// the first line that changed in file otherwise.
+func (r *reducer) attempt(file string, pos token.Position, before, after []byte) error {
+	start := time.Now()
+	err := r.checkRun()
+	if r.events == nil {
+		return err
+	}
+	b, a, line := snippets(before, after)
+	if !pos.IsValid() {
+		pos = token.Position{Filename: file, Line: line}
+	}
+	r.emit(event{
+		Kind:     "attempt",
+		Pos:      posString(pos),
+		Before:   b,
+		After:    a,
+		OK:       err == nil,
+		Duration: time.Since(start).Seconds(),
+		Size:     r.size() - len(before) + len(after),
+	})
+	return err
+}
+
+// accepted records the event for a change that was kept.
+func (r *reducer) accepted(pos token.Position, msg string) {
+	now := time.Now()
+	r.emit(event{
+		Kind:     "accept",
+		Pos:      posString(pos),
+		Message:  msg,
+		OK:       true,
+		Duration: now.Sub(r.lastAccept).Seconds(),
+		Size:     r.size(),
+	})
+	r.lastAccept = now
+}
+
+// size returns the number of bytes of the files being reduced, as they are
+// in the workspace.
+func (r *reducer) size() int {
+	n := 0
+	for _, src := range r.goodSrc {
+		n += len(src)
+	}
+	for _, f := range r.auxFiles() {
+		n += len(f.String())
+	}
+	return n
+}
+
+func posString(pos token.Position) string {
+	s := pos.Filename
+	if pos.Line > 0 {
+		s += ":" + strconv.Itoa(pos.Line)
+	}
+	return s
+}
+
+// snippets returns the lines that differ between before and after, cut at
+// maxSnippet bytes, and the line at which they start.
+func snippets(before, after []byte) (b, a string, line int) {
+	start := 0
+	for start < len(before) && start < len(after) && before[start] == after[start] {
+		start++
+	}
+	end := 0
+	for end < len(before)-start && end < len(after)-start &&
+		before[len(before)-1-end] == after[len(after)-1-end] {
+		end++
+	}
+	// extend the differences to whole lines
+	start = bytes.LastIndexByte(before[:start], '\n') + 1
+	for end > 0 && before[len(before)-end] != '\n' {
+		end--
+	}
+	line = 1 + bytes.Count(before[:start], []byte("\n"))
+	return cut(before[start : len(before)-end]), cut(after[start : len(after)-end]), line
+}
+
+func cut(b []byte) string {
+	if len(b) > maxSnippet {
+		return string(b[:maxSnippet]) + "..."
+	}
+	return string(b)
+}
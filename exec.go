@@ -0,0 +1,182 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/interp"
+)
+
+// usage is the amount of resources used by a shell command, including all the
+// processes it started.
+type usage struct {
+	maxRSS int64 // peak memory of any single process, in bytes
+	cpu    time.Duration
+	wall   time.Duration
+	size   int64 // size of the output file, in bytes
+}
+
+// execModule replaces interp.DefaultExec, keeping track of the resources used
+// by each of the programs that the shell commands run. It also runs the
+// goreduce builtins.
+func (r *reducer) execModule(next interp.ExecModule) interp.ExecModule {
+	return func(ctx context.Context, path string, args []string) error {
+		mc, _ := interp.FromModuleContext(ctx)
+		return r.exec(ctx, mc, path, args, mc.Stdout, mc.Stderr)
+	}
+}
+
+// exec runs a program or a builtin for a shell command. If path is empty,
+// the program is looked up in the shell's PATH.
+func (r *reducer) exec(ctx context.Context, mc interp.ModuleCtx, path string, args []string, stdout, stderr io.Writer) error {
+	if ok, err := r.builtin(ctx, mc, args, stdout, stderr); ok {
+		return err
+	}
+	if path == "" {
+		path, _ = lookPath(execEnv(mc), mc.Dir, args[0])
+	}
+	if path == "" {
+		fmt.Fprintf(stderr, "%q: executable file not found in $PATH\n", args[0])
+		return interp.ExitStatus(127)
+	}
+	cmd := newCmd(ctx, path, args)
+	cmd.Env = execEnv(mc)
+	cmd.Dir = mc.Dir
+	cmd.Stdin = mc.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	r.addUsage(cmd.ProcessState)
+	return exitStatus(ctx, err, stderr)
+}
+
+// runArgv runs a program directly in the package's directory, with the same
+// environment, input and output as the shell commands. As with the embedded
+// interpreter, a non-zero exit status is returned as an interp.ExitStatus.
+func (r *reducer) runArgv(ctx context.Context, argv []string, stdin io.Reader, out io.Writer) error {
+	path, err := lookPath(r.env, r.tdir, argv[0])
+	if err != nil {
+		fmt.Fprintf(out, "%v\n", err)
+		return interp.ExitStatus(127)
+	}
+	cmd := newCmd(ctx, path, argv)
+	cmd.Env = r.env
+	cmd.Dir = r.tdir
+	cmd.Stdin = stdin
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Run()
+	r.addUsage(cmd.ProcessState)
+	if x, ok := err.(*exec.ExitError); ok {
+		if status, ok := x.Sys().(syscall.WaitStatus); ok {
+			return interp.ExitStatus(status.ExitStatus())
+		}
+		return interp.ExitStatus(1)
+	}
+	return err
+}
+
+// newCmd returns a command that runs a program in its own process group.
+// When ctx is done, the whole group is killed, as the output stays open
+// while any of the processes that the program started are running.
+func newCmd(ctx context.Context, path string, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Args = args
+	setProcGroup(cmd)
+	cmd.Cancel = func() error { return killProcGroup(cmd) }
+	return cmd
+}
+
+// lookPath finds a program like a shell would, in the PATH of env. A path
+// with a slash is relative to dir.
+func lookPath(env []string, dir, file string) (string, error) {
+	if strings.Contains(file, "/") {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		return exec.LookPath(file)
+	}
+	for _, pdir := range filepath.SplitList(getEnv(env, "PATH")) {
+		if path, err := exec.LookPath(filepath.Join(pdir, file)); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%q: executable file not found in $PATH", file)
+}
+
+// execEnv returns the exported variables of a shell environment, as expected
+// by os/exec.
+func execEnv(mc interp.ModuleCtx) []string {
+	var list []string
+	mc.Env.Each(func(name string, vr expand.Variable) bool {
+		if vr.Exported {
+			list = append(list, name+"="+vr.String())
+		}
+		return true
+	})
+	return list
+}
+
+// exitStatus converts an error from os/exec into one for the shell
+// interpreter, following interp.DefaultExec.
+func exitStatus(ctx context.Context, err error, stderr io.Writer) error {
+	switch x := err.(type) {
+	case *exec.ExitError:
+		// started, but errored - default to 1 if OS
+		// doesn't have exit statuses
+		if status, ok := x.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return interp.ExitStatus(status.ExitStatus())
+		}
+		return interp.ExitStatus(1)
+	case *exec.Error:
+		// did not start
+		fmt.Fprintf(stderr, "%v\n", err)
+		return interp.ExitStatus(127)
+	default:
+		return err
+	}
+}
+
+// report prints the settings that the commands ran with, as they are needed
+// to reproduce the behavior of the reduced program too.
+func (r *reducer) report(opts options) {
+	if opts.shell != "" && opts.shell != "interp" {
+		fmt.Fprintf(r.logOut, "command shell: %s\n", opts.shell)
+	}
+	for _, kv := range opts.env {
+		fmt.Fprintf(r.logOut, "command env: %s\n", kv)
+	}
+	for _, name := range opts.unsetEnv {
+		fmt.Fprintf(r.logOut, "command unsetenv: %s\n", name)
+	}
+	if opts.stdin != "" {
+		fmt.Fprintf(r.logOut, "command stdin: %s\n", opts.stdin)
+	}
+	for _, name := range opts.files {
+		fmt.Fprintf(r.logOut, "command file: %s\n", name)
+	}
+}
+
+func (r *reducer) addUsage(ps *os.ProcessState) {
+	if ps == nil {
+		return
+	}
+	r.usage.cpu += ps.UserTime() + ps.SystemTime()
+	if rss := maxRSS(ps); rss > r.usage.maxRSS {
+		r.usage.maxRSS = rss
+	}
+}
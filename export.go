@@ -0,0 +1,100 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// exportImporter imports packages from the export data that the go command
+// builds for them, as listed by "go list -export". Unlike the export data
+// installed in GOROOT, this works for the standard library of any toolchain,
+// for module dependencies and for vendored packages alike.
+type exportImporter struct {
+	bin   string
+	dir   string
+	env   []string
+	flags []string
+
+	files  map[string]string // export data file per import path
+	failed map[string]error  // error listing a path, so it isn't listed again
+	imp    types.Importer
+}
+
+// newExportImporter returns an importer for the packages that the package in
+// dir and its tests depend on, directly or not, which are all listed on the
+// first import. Packages that aren't dependencies yet, such as those imported
+// by inlined code, are listed when they are first imported.
+func newExportImporter(bin, dir string, env, flags []string) *exportImporter {
+	e := &exportImporter{bin: bin, dir: dir, env: env, flags: flags}
+	// Its own file set, as the positions of imported objects are never
+	// logged and must not shift those of the files being reduced.
+	e.imp = importer.ForCompiler(token.NewFileSet(), "gc", e.lookup)
+	return e
+}
+
+// list records the export data of the given packages and their dependencies.
+// The packages that fail to build, such as the one being reduced, have none.
+func (e *exportImporter) list(args ...string) error {
+	args = append([]string{"list", "-e", "-export", "-deps", "-f",
+		"{{.ImportPath}}\t{{.Export}}"}, append(e.flags, args...)...)
+	cmd := exec.Command(e.bin, args...)
+	cmd.Dir = e.dir
+	cmd.Env = e.env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("go list: %v\n%s", err, stderr.Bytes())
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) == 2 && fields[1] != "" {
+			e.files[fields[0]] = fields[1]
+		}
+	}
+	return nil
+}
+
+func (e *exportImporter) lookup(path string) (io.ReadCloser, error) {
+	if e.files == nil {
+		e.files = make(map[string]string)
+		if err := e.list("-test", "."); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.failed[path]; err != nil {
+		return nil, err
+	}
+	file, ok := e.files[path]
+	if !ok {
+		if err := e.list(path); err != nil {
+			if e.failed == nil {
+				e.failed = make(map[string]error)
+			}
+			e.failed[path] = err
+			return nil, err
+		}
+		file = e.files[path]
+		e.files[path] = file // don't list it again
+	}
+	if file == "" {
+		return nil, fmt.Errorf("no export data for %s", path)
+	}
+	return os.Open(file)
+}
+
+func (e *exportImporter) Import(path string) (*types.Package, error) {
+	return e.imp.Import(path)
+}
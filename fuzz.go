@@ -0,0 +1,214 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const fuzzHeader = "go test fuzz v1\n"
+
+// fuzzEntry is a fuzz corpus entry, such as the one written by go test when
+// fuzzing finds a failure.
+type fuzzEntry struct {
+	file   *auxFile // path like testdata/fuzz/FuzzFoo/<hash>
+	name   string   // name of the fuzz test, such as FuzzFoo
+	hash   string
+	values []fuzzValue
+}
+
+// fuzzValue is a value in a fuzz corpus entry, such as int(3) or
+// []byte("foo").
+type fuzzValue struct {
+	typ  string
+	lit  string
+	line int // line in the original file, for the log
+}
+
+func (v fuzzValue) String() string { return v.typ + "(" + v.lit + ")" }
+
+func readFuzzEntry(dir, name string) (*fuzzEntry, error) {
+	f, err := readAuxFile(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	e := &fuzzEntry{
+		file: f,
+		name: path.Base(path.Dir(name)),
+		hash: path.Base(name),
+	}
+	if len(f.lines) == 0 || f.lines[0] != fuzzHeader {
+		return nil, fmt.Errorf("%s: not a fuzz corpus file", name)
+	}
+	for i, line := range f.lines[1:] {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		open := strings.IndexByte(line, '(')
+		if open < 0 || !strings.HasSuffix(line, ")") {
+			return nil, fmt.Errorf("%s:%d: malformed value", name, i+2)
+		}
+		e.values = append(e.values, fuzzValue{
+			typ:  line[:open],
+			lit:  line[open+1 : len(line)-1],
+			line: i + 2,
+		})
+	}
+	return e, nil
+}
+
+// runCmd returns the command that runs the fuzz test with the entry.
+func (e *fuzzEntry) runCmd() string {
+	return fmt.Sprintf("go test -count=1 -run '^%s$/^%s$'", e.name, e.hash)
+}
+
+func (e *fuzzEntry) lines(values []fuzzValue) []string {
+	lines := []string{fuzzHeader}
+	for _, v := range values {
+		lines = append(lines, v.String()+"\n")
+	}
+	return lines
+}
+
+// reduceFuzz shrinks the values in the fuzz corpus entry, one at a time.
+func (r *reducer) reduceFuzz() (anyChanges bool) {
+	e := r.fuzz
+	for i, v := range e.values {
+		try := func(lit string) bool {
+			values := append([]fuzzValue(nil), e.values...)
+			values[i].lit = lit
+			lines := e.lines(values)
+			if !r.tryAux(e.file, lines, e.file.orig[:len(lines)]) {
+				return false
+			}
+			e.values = values
+			return true
+		}
+		if !shrinkValue(v, try) {
+			continue
+		}
+		r.logPos(token.Position{
+			Filename: filepath.Join(r.dir, filepath.FromSlash(e.file.name)),
+			Line:     v.line,
+		}, "%s -> %s", v, e.values[i])
+		anyChanges = true
+	}
+	return anyChanges
+}
+
+// shrinkValue tries smaller literals for a fuzz value, reporting whether any
+// of them was kept by try.
+func shrinkValue(v fuzzValue, try func(lit string) bool) bool {
+	switch v.typ {
+	case "string", "[]byte":
+		s, err := strconv.Unquote(v.lit)
+		if err != nil {
+			return false
+		}
+		changed := false
+		ddmin(len(s), func(keep []int) bool {
+			var buf bytes.Buffer
+			for _, k := range keep {
+				buf.WriteByte(s[k])
+			}
+			if try(strconv.Quote(buf.String())) {
+				changed = true
+				return true
+			}
+			return false
+		})
+		return changed
+	case "int", "int8", "int16", "int32", "int64",
+		"uint", "uint8", "uint16", "uint32", "uint64", "uintptr":
+		n, err := strconv.ParseInt(v.lit, 0, 64)
+		if err != nil {
+			// too large for an int64
+			return v.lit != "0" && try("0")
+		}
+		changed := false
+		for n != 0 {
+			if try("0") {
+				return true
+			}
+			if !try(strconv.FormatInt(n/2, 10)) {
+				break
+			}
+			n /= 2
+			changed = true
+		}
+		return changed
+	case "float32", "float64":
+		return v.lit != "0" && try("0")
+	case "bool":
+		return v.lit != "false" && try("false")
+	case "byte", "rune":
+		return v.lit != `'\x00'` && try(`'\x00'`)
+	}
+	return false
+}
+
+// inlineFuzz adds a unit test to the file declaring the fuzz test, which calls
+// the fuzz function with the values of the corpus entry.
+func (r *reducer) inlineFuzz() error {
+	e := r.fuzz
+	for _, file := range r.allFiles() {
+		for _, decl := range file.Decls {
+			fd, _ := decl.(*ast.FuncDecl)
+			if fd == nil || fd.Recv != nil || fd.Name.Name != e.name {
+				continue
+			}
+			lit := fuzzFuncLit(fd)
+			if lit == nil {
+				return fmt.Errorf("could not find the function passed to %s's Fuzz", e.name)
+			}
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, "\nfunc Test%sReduced(t *testing.T) {\n", e.name)
+			if err := printer.Fprint(&buf, r.fset, lit); err != nil {
+				return err
+			}
+			buf.WriteString("(t")
+			for _, v := range e.values {
+				buf.WriteString(", " + v.String())
+			}
+			buf.WriteString(")\n}\n")
+
+			fname := r.fset.Position(file.Pos()).Filename
+			src, err := ioutil.ReadFile(fname)
+			if err != nil {
+				return err
+			}
+			src, err = format.Source(append(src, buf.Bytes()...))
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(fname, src, 0666)
+		}
+	}
+	return fmt.Errorf("could not find the fuzz test %s", e.name)
+}
+
+// fuzzFuncLit returns the function literal given to f.Fuzz in a fuzz test.
+func fuzzFuncLit(fd *ast.FuncDecl) (lit *ast.FuncLit) {
+	ast.Inspect(fd.Body, func(node ast.Node) bool {
+		call, _ := node.(*ast.CallExpr)
+		if call == nil || len(call.Args) != 1 {
+			return lit == nil
+		}
+		if sel, _ := call.Fun.(*ast.SelectorExpr); sel != nil && sel.Sel.Name == "Fuzz" {
+			lit, _ = call.Args[0].(*ast.FuncLit)
+		}
+		return lit == nil
+	})
+	return lit
+}
@@ -7,4 +7,4 @@ require (
 	mvdan.cc/sh/v3 v3.0.0-alpha2
 )
 
-go 1.13
+go 1.21
@@ -0,0 +1,157 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// module describes the Go module containing the package being reduced.
+type module struct {
+	root      string // directory containing go.mod
+	path      string // module path
+	goVersion string // go directive, if any
+
+	file *goModFile // parsed go.mod, if there is one
+	sum  []string   // lines of go.sum, if there is one
+}
+
+// findModule finds the module containing dir, by looking for a go.mod file in
+// it or any of its parents. If there is none, it returns a module named "tmp"
+// rooted at dir, as if it contained an empty go.mod file.
+func findModule(dir string) (module, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return module{}, err
+	}
+	for cur := dir; ; {
+		data, err := ioutil.ReadFile(filepath.Join(cur, "go.mod"))
+		if err == nil {
+			mod := module{root: cur, file: parseGoModFile(data)}
+			for _, st := range mod.file.stmts {
+				fields := mod.file.fields(st)
+				if st.block >= 0 || len(fields) != 1 {
+					continue
+				}
+				switch st.verb {
+				case "module":
+					mod.path = fields[0]
+					if unq, err := strconv.Unquote(mod.path); err == nil {
+						mod.path = unq
+					}
+				case "go":
+					mod.goVersion = fields[0]
+				}
+			}
+			if mod.path == "" {
+				return module{}, fmt.Errorf("%s: no module directive",
+					filepath.Join(cur, "go.mod"))
+			}
+			sum, err := ioutil.ReadFile(filepath.Join(cur, "go.sum"))
+			if err == nil {
+				mod.sum = splitLines(string(sum))
+			} else if !os.IsNotExist(err) {
+				return module{}, err
+			}
+			return mod, nil
+		}
+		if !os.IsNotExist(err) {
+			return module{}, err
+		}
+		parent := filepath.Dir(cur)
+		if parent == cur {
+			break
+		}
+		cur = parent
+	}
+	return module{root: dir, path: "tmp"}, nil
+}
+
+// pkgDir returns the directory of a package of the module, given its import
+// path. It reports false if the package is not part of the module.
+func (m module) pkgDir(imp string) (string, bool) {
+	if imp != m.path && !strings.HasPrefix(imp, m.path+"/") {
+		return "", false
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(imp, m.path), "/")
+	return filepath.Join(m.root, filepath.FromSlash(rel)), true
+}
+
+// rel returns the path of dir relative to the module root, using forward
+// slashes.
+func (m module) rel(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(m.root, dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// inDir reports whether the module's go.mod file is in dir.
+func (m module) inDir(dir string) bool {
+	dir, err := filepath.Abs(dir)
+	return err == nil && dir == m.root
+}
+
+// writeGoMod writes the go.mod and go.sum files for the module in the
+// workspace directory. The given third-party modules are required and
+// replaced by their copies in the workspace.
+func (m module) writeGoMod(wdir string, deps []*depModule) error {
+	var content string
+	if m.file != nil {
+		// the copies replace any of the original requirements
+		copied := make(map[string]bool, len(deps))
+		for _, dep := range deps {
+			copied[dep.path] = true
+		}
+		content = m.file.text(func(st modStmt, line string) string {
+			switch st.verb {
+			case "require", "replace":
+				if fields := m.file.fields(st); len(fields) > 0 && copied[fields[0]] {
+					return ""
+				}
+			}
+			if st.verb == "replace" {
+				return absReplace(line, m.root)
+			}
+			return line
+		})
+	} else {
+		content = "module " + m.path + "\n"
+		if m.goVersion != "" {
+			content += "\ngo " + m.goVersion + "\n"
+		}
+	}
+	if len(deps) > 0 {
+		content += "\nrequire (\n"
+		for _, dep := range deps {
+			version := dep.version
+			if version == "" {
+				version = "v0.0.0"
+			}
+			content += "\t" + dep.path + " " + version + "\n"
+		}
+		content += ")\n\nreplace (\n"
+		for _, dep := range deps {
+			content += "\t" + dep.path + " => ./" + dep.dir() + "\n"
+		}
+		content += ")\n"
+	}
+	if err := ioutil.WriteFile(filepath.Join(wdir, "go.mod"), []byte(content), 0666); err != nil {
+		return err
+	}
+	if m.sum == nil {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(wdir, "go.sum"), []byte(strings.Join(m.sum, "")), 0666)
+}
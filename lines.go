@@ -0,0 +1,522 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ddmin reduces a list of n units, such as lines, with delta debugging. The
+// units are removed in chunks, from halves down to single units. try is given
+// the indexes of the units to keep, and reports whether the result was still
+// interesting. The indexes of the units that were kept are returned.
+func ddmin(n int, try func(keep []int) bool) []int {
+	keep := make([]int, n)
+	for i := range keep {
+		keep[i] = i
+	}
+	chunks := 2
+	for len(keep) > 0 {
+		if chunks > len(keep) {
+			chunks = len(keep)
+		}
+		size := (len(keep) + chunks - 1) / chunks
+		removed := false
+		for start := 0; start < len(keep); start += size {
+			end := start + size
+			if end > len(keep) {
+				end = len(keep)
+			}
+			cand := append(keep[:start:start], keep[end:]...)
+			if try(cand) {
+				keep = cand
+				removed = true
+				break
+			}
+		}
+		switch {
+		case removed:
+			if chunks--; chunks < 2 {
+				chunks = 2
+			}
+		case chunks >= len(keep):
+			return keep
+		default:
+			chunks *= 2
+		}
+	}
+	return keep
+}
+
+// splitLines splits a string into lines, keeping their trailing newlines.
+func splitLines(s string) []string {
+	var lines []string
+	for s != "" {
+		i := strings.IndexByte(s, '\n') + 1
+		if i == 0 {
+			i = len(s)
+		}
+		lines = append(lines, s[:i])
+		s = s[i:]
+	}
+	return lines
+}
+
+// auxFile is a file that is not Go code, such as an assembly file or an input
+// file read by the program, reduced line by line.
+type auxFile struct {
+	name  string   // path relative to the package, such as foo_amd64.s
+	lines []string // current lines, with their trailing newlines
+	orig  []int    // original line number of each line
+}
+
+func readAuxFile(dir, name string) (*auxFile, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	f := &auxFile{name: name, lines: splitLines(string(data))}
+	for i := range f.lines {
+		f.orig = append(f.orig, i+1)
+	}
+	return f, nil
+}
+
+func (f *auxFile) String() string { return strings.Join(f.lines, "") }
+
+func (f *auxFile) isAsm() bool { return strings.HasSuffix(f.name, ".s") }
+
+var (
+	textRe   = regexp.MustCompile(`^\s*TEXT\s+[\w./]*·(\w+)\(SB\)`)
+	asmSymRe = regexp.MustCompile(`^\s*(TEXT|DATA|GLOBL)\b`)
+)
+
+// textSymbols returns the Go functions implemented in a list of lines.
+func textSymbols(lines []string) map[string]bool {
+	syms := make(map[string]bool)
+	for _, line := range lines {
+		if m := textRe.FindStringSubmatch(line); m != nil {
+			syms[m[1]] = true
+		}
+	}
+	return syms
+}
+
+// textBlock returns the range of lines implementing the Go function name,
+// from its TEXT line until the next symbol.
+func textBlock(lines []string, name string) (start, end int, ok bool) {
+	for i, line := range lines {
+		if m := textRe.FindStringSubmatch(line); m != nil && m[1] == name {
+			end := i + 1
+			for end < len(lines) && !asmSymRe.MatchString(lines[end]) {
+				end++
+			}
+			return i, end, true
+		}
+	}
+	return 0, 0, false
+}
+
+func pickLines(lines []string, orig []int, keep []int) ([]string, []int) {
+	newLines := make([]string, len(keep))
+	newOrig := make([]int, len(keep))
+	for i, k := range keep {
+		newLines[i] = lines[k]
+		newOrig[i] = orig[k]
+	}
+	return newLines, newOrig
+}
+
+// firstRemoved returns the original number of the first line that is not
+// in keep.
+func firstRemoved(orig []int, keep []int) int {
+	for i, k := range keep {
+		if k != i {
+			return orig[i]
+		}
+	}
+	return orig[len(keep)]
+}
+
+// splitBytes splits lines into units of single bytes, keeping the original
+// line numbers.
+func splitBytes(lines []string, orig []int) ([]string, []int) {
+	var units []string
+	var unitOrig []int
+	for i, line := range lines {
+		for j := 0; j < len(line); j++ {
+			units = append(units, line[j:j+1])
+			unitOrig = append(unitOrig, orig[i])
+		}
+	}
+	return units, unitOrig
+}
+
+// joinBytes joins units of bytes back into lines. Each line keeps the original
+// line number of its first byte.
+func joinBytes(units []string, orig []int) ([]string, []int) {
+	var lines []string
+	var lineOrig []int
+	start := 0
+	for i, unit := range units {
+		if unit == "\n" || i == len(units)-1 {
+			lines = append(lines, strings.Join(units[start:i+1], ""))
+			lineOrig = append(lineOrig, orig[start])
+			start = i + 1
+		}
+	}
+	return lines, lineOrig
+}
+
+// relInput cleans the path of an input file, which must be relative to the
+// package directory.
+func relInput(dir, name string) (string, error) {
+	name = filepath.ToSlash(filepath.Clean(name))
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("input file %s is not within %s", name, dir)
+	}
+	return name, nil
+}
+
+// copyAux writes a file into the workspace, creating its directory.
+func (r *reducer) copyAux(f *auxFile) error {
+	fname := filepath.Join(r.tdir, filepath.FromSlash(f.name))
+	if err := os.MkdirAll(filepath.Dir(fname), 0777); err != nil {
+		return err
+	}
+	return r.writeAux(f, f.lines)
+}
+
+func (r *reducer) writeAux(f *auxFile, lines []string) error {
+	src := strings.Join(lines, "")
+	fname := filepath.Join(r.tdir, filepath.FromSlash(f.name))
+	return ioutil.WriteFile(fname, []byte(src), 0666)
+}
+
+// reduceLines runs the line-based passes, which reduce the parts of the
+// package that are not Go code. It is run when the AST passes did not find
+// any more changes.
+func (r *reducer) reduceLines() (anyChanges bool) {
+	for _, file := range r.allFiles() {
+		if cg := cgoPreamble(file); cg != nil && r.reducePreamble(file, cg) {
+			anyChanges = true
+		}
+	}
+	for _, f := range r.asmFiles {
+		if r.reduceAux(f, false) {
+			anyChanges = true
+		}
+	}
+	if r.fuzz != nil && r.reduceFuzz() {
+		anyChanges = true
+	}
+	for _, f := range r.inputs {
+		// lines first, as they are much faster to get rid of
+		if r.reduceAux(f, false) {
+			anyChanges = true
+		}
+		if r.reduceAux(f, true) {
+			anyChanges = true
+		}
+	}
+	r.didChange = false
+	return anyChanges
+}
+
+// reduceAux removes lines, or bytes if bytes is true, from a file that is
+// not Go code. Removing the TEXT line of a function from an assembly file also
+// removes its Go declaration.
+func (r *reducer) reduceAux(f *auxFile, bytes bool) bool {
+	base, baseOrig, unit := f.lines, f.orig, "lines"
+	if bytes {
+		base, baseOrig = splitBytes(f.lines, f.orig)
+		unit = "bytes"
+	}
+	keep := ddmin(len(base), func(keep []int) bool {
+		lines, orig := pickLines(base, baseOrig, keep)
+		if bytes {
+			lines, orig = joinBytes(lines, orig)
+		}
+		return r.tryAux(f, lines, orig)
+	})
+	if len(keep) == len(base) {
+		return false
+	}
+	r.logPos(token.Position{
+		Filename: filepath.Join(r.dir, filepath.FromSlash(f.name)),
+		Line:     firstRemoved(baseOrig, keep),
+	}, "removed %d %s", len(base)-len(keep), unit)
+	return true
+}
+
+func (r *reducer) tryAux(f *auxFile, lines []string, orig []int) bool {
+	key := f.name + "\x00" + strings.Join(lines, "")
+	if r.tried[key] {
+		return false
+	}
+	r.tried[key] = true
+	r.tries++
+
+	// drop the Go declarations of the functions that are gone
+	kept := textSymbols(lines)
+	type undoDecls struct {
+		file     *ast.File
+		decls    []ast.Decl
+		comments []*ast.CommentGroup
+	}
+	var undos []undoDecls
+	for name := range textSymbols(f.lines) {
+		if kept[name] || !f.isAsm() {
+			continue
+		}
+		for _, file := range r.allFiles() {
+			for i, decl := range file.Decls {
+				fd, _ := decl.(*ast.FuncDecl)
+				if fd == nil || fd.Body != nil || fd.Recv != nil || fd.Name.Name != name {
+					continue
+				}
+				undos = append(undos, undoDecls{file, file.Decls, file.Comments})
+				file.Decls = append(file.Decls[:i:i], file.Decls[i+1:]...)
+				file.Comments = withoutGroup(file.Comments, fd.Doc)
+				break
+			}
+		}
+	}
+	restore := func() {
+		for i := len(undos) - 1; i >= 0; i-- {
+			undos[i].file.Decls = undos[i].decls
+			undos[i].file.Comments = undos[i].comments
+			r.writeTmp(undos[i].file, r.goodSrc[undos[i].file])
+		}
+		r.writeAux(f, f.lines)
+	}
+	srcs := make(map[*ast.File][]byte)
+	for _, undo := range undos {
+		src, err := r.printFile(undo.file)
+		if err != nil {
+			restore()
+			return false
+		}
+		srcs[undo.file] = src
+		r.writeTmp(undo.file, src)
+	}
+	if err := r.writeAux(f, lines); err != nil {
+		restore()
+		return false
+	}
+	// the original line where the change starts
+	var pos token.Position
+	for i, line := range lines {
+		if i >= len(f.lines) || line != f.lines[i] {
+			pos = token.Position{Filename: filepath.Join(r.dir, filepath.FromSlash(f.name)), Line: orig[i]}
+			break
+		}
+	}
+	if err := r.attempt(filepath.Join(r.dir, filepath.FromSlash(f.name)), pos,
+		[]byte(f.String()), []byte(strings.Join(lines, ""))); err != nil {
+		restore()
+		return false
+	}
+	for file, src := range srcs {
+		r.goodSrc[file] = src
+	}
+	f.lines, f.orig = lines, orig
+	r.acceptedChange(key)
+	return true
+}
+
+// removeAsmFunc removes an unused Go function declared without a body, along
+// with its TEXT symbols in the assembly files.
+func (r *reducer) removeAsmFunc(fd *ast.FuncDecl) bool {
+	if fd.Recv != nil || len(r.useIdents[r.info.Defs[fd.Name]]) > 0 {
+		return false
+	}
+	type undoLines struct {
+		f     *auxFile
+		lines []string
+		orig  []int
+	}
+	var undos []undoLines
+	for _, f := range r.asmFiles {
+		start, end, ok := textBlock(f.lines, fd.Name.Name)
+		if !ok {
+			continue
+		}
+		undos = append(undos, undoLines{f, f.lines, f.orig})
+		f.lines = append(f.lines[:start:start], f.lines[end:]...)
+		f.orig = append(f.orig[:start:start], f.orig[end:]...)
+		r.writeAux(f, f.lines)
+	}
+	if len(undos) == 0 {
+		return false
+	}
+	orig := r.file.Decls
+	for i, decl := range orig {
+		if decl == fd {
+			r.file.Decls = append(orig[:i:i], orig[i+1:]...)
+			break
+		}
+	}
+	// directives such as //go:noescape go away with the func
+	undoDoc := r.removeDoc(fd.Doc)
+	if r.okChange() {
+		r.mergeLines(fd.Pos(), fd.End()+1)
+		return true
+	}
+	r.file.Decls = orig
+	undoDoc()
+	for _, undo := range undos {
+		undo.f.lines, undo.f.orig = undo.lines, undo.orig
+		r.writeAux(undo.f, undo.f.lines)
+	}
+	return false
+}
+
+// cgoPreamble returns the comment above import "C" in a file, if any.
+func cgoPreamble(file *ast.File) *ast.CommentGroup {
+	for _, decl := range file.Decls {
+		gd, _ := decl.(*ast.GenDecl)
+		if gd == nil || gd.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			imp := spec.(*ast.ImportSpec)
+			if path, _ := strconv.Unquote(imp.Path.Value); path != "C" {
+				continue
+			}
+			if imp.Doc != nil {
+				return imp.Doc
+			}
+			if !gd.Lparen.IsValid() {
+				return gd.Doc
+			}
+		}
+	}
+	return nil
+}
+
+// preambleLine is a line of a cgo preamble, which is either a line comment or
+// a line within a block comment.
+type preambleLine struct {
+	comment int // index of the comment in the group
+	line    int // line number in the file
+	text    string
+	block   bool
+}
+
+// reducePreamble removes lines from the C code in a cgo preamble. While
+// reducing, removed lines are left empty, as the preamble must stay right
+// above the import. The empty lines are removed at the end.
+func (r *reducer) reducePreamble(file *ast.File, cg *ast.CommentGroup) bool {
+	r.file = file
+	orig := cg.List
+	var lines []preambleLine
+	for i, c := range orig {
+		line := r.fset.Position(c.Slash).Line
+		if strings.HasPrefix(c.Text, "//") {
+			lines = append(lines, preambleLine{comment: i, line: line, text: c.Text})
+			continue
+		}
+		for j, text := range strings.Split(c.Text[2:len(c.Text)-2], "\n") {
+			lines = append(lines, preambleLine{
+				comment: i, line: line + j, text: text, block: true,
+			})
+		}
+	}
+	build := func(keep []int, pad bool) []*ast.Comment {
+		kept := make([]bool, len(lines))
+		for _, k := range keep {
+			kept[k] = true
+		}
+		var list []*ast.Comment
+		for i, c := range orig {
+			if strings.HasPrefix(c.Text, "//") {
+				for k, pl := range lines {
+					switch {
+					case pl.comment != i:
+					case kept[k]:
+						list = append(list, c)
+					case pad:
+						list = append(list, &ast.Comment{Slash: c.Slash, Text: "//"})
+					}
+				}
+				continue
+			}
+			var block []string
+			for k, pl := range lines {
+				switch {
+				case pl.comment != i:
+				case kept[k]:
+					block = append(block, pl.text)
+				case pad:
+					block = append(block, "")
+				}
+			}
+			list = append(list, &ast.Comment{
+				Slash: c.Slash,
+				Text:  "/*" + strings.Join(block, "\n") + "*/",
+			})
+		}
+		return list
+	}
+	padded := orig
+	keep := ddmin(len(lines), func(keep []int) bool {
+		cg.List = build(keep, true)
+		r.didChange = false
+		if r.okChangeNoUndo() {
+			padded = cg.List
+			return true
+		}
+		cg.List = padded
+		return false
+	})
+	if len(keep) == len(lines) {
+		return false
+	}
+	// Remove the empty lines, merging them in the file so that the
+	// comments stay together and right above the import. Merging lines
+	// cannot be undone, so the line table is kept to restore it.
+	cg.List = build(keep, false)
+	height := make([]int, len(orig))
+	for _, k := range keep {
+		height[lines[k].comment]++
+	}
+	tfile := r.fset.File(cg.Pos())
+	origLines := tfile.Lines()
+	shifted := 0
+	moveTo := func(line, newLine int) {
+		for ; line > newLine; line-- {
+			tfile.MergeLine(newLine)
+			shifted++
+		}
+	}
+	cur := lines[0].line
+	for i, c := range orig {
+		if strings.HasPrefix(c.Text, "/*") && height[i] == 0 {
+			height[i] = 1 // an empty block comment
+		}
+		if height[i] == 0 {
+			continue
+		}
+		moveTo(r.fset.Position(c.Slash).Line, cur)
+		cur += height[i]
+	}
+	moveTo(lines[len(lines)-1].line+1-shifted, cur)
+	r.didChange = false
+	if !r.okChangeNoUndo() {
+		tfile.SetLines(origLines)
+		cg.List = padded
+		return false
+	}
+	r.logChange(cg, "removed %d lines of cgo preamble", len(lines)-len(keep))
+	return true
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// buildContext returns the context used to select the files of the package,
+// following the -tags, -goos, -goarch and -cgo options.
+func (o *options) buildContext() build.Context {
+	ctx := build.Default
+	if o.goos != "" {
+		ctx.GOOS = o.goos
+	}
+	if o.goarch != "" {
+		ctx.GOARCH = o.goarch
+	}
+	switch o.cgo {
+	case "0":
+		ctx.CgoEnabled = false
+	case "1":
+		ctx.CgoEnabled = true
+	}
+	if o.tags != "" {
+		ctx.BuildTags = strings.Split(o.tags, ",")
+	}
+	return ctx
+}
+
+// buildEnv returns the environment that the shell commands should run with,
+// so that the go tool selects the same files that are being reduced.
+func (o *options) buildEnv(env []string) []string {
+	if o.goos != "" {
+		env = setEnv(env, "GOOS", o.goos)
+	}
+	if o.goarch != "" {
+		env = setEnv(env, "GOARCH", o.goarch)
+	}
+	if o.cgo != "" {
+		env = setEnv(env, "CGO_ENABLED", o.cgo)
+	}
+	if o.tags != "" {
+		flags := strings.TrimSpace(getEnv(env, "GOFLAGS") + " -tags=" + o.tags)
+		env = setEnv(env, "GOFLAGS", flags)
+	}
+	return env
+}
+
+// setEnv sets a variable in an environment list, replacing any previous value.
+func setEnv(env []string, name, value string) []string {
+	return append(unsetEnv(env, name), name+"="+value)
+}
+
+// unsetEnv removes a variable from an environment list.
+func unsetEnv(env []string, name string) []string {
+	for i, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return append(env[:i:i], env[i+1:]...)
+		}
+	}
+	return env
+}
+
+// cmdEnv applies the -env and -unsetenv options to an environment list, in
+// that order, so that -unsetenv wins.
+func (o *options) cmdEnv(env []string) ([]string, error) {
+	for _, kv := range o.env {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("-env must be NAME=value, got %q", kv)
+		}
+		env = setEnv(env, kv[:i], kv[i+1:])
+	}
+	for _, name := range o.unsetEnv {
+		env = unsetEnv(env, name)
+	}
+	return env, nil
+}
+
+func getEnv(env []string, name string) string {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return kv[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// parsePackage parses the Go files in dir that match the build context,
+// including test files. If the directory also contains an external test
+// package, it is returned as a second package.
+func parsePackage(fset *token.FileSet, bp *build.Package, mode parser.Mode) (map[string]*ast.Package, error) {
+	pkgs := make(map[string]*ast.Package)
+	var names []string
+	for _, list := range [...][]string{bp.GoFiles, bp.CgoFiles, bp.TestGoFiles, bp.XTestGoFiles} {
+		names = append(names, list...)
+	}
+	for _, name := range names {
+		path := filepath.Join(bp.Dir, name)
+		f, err := parser.ParseFile(fset, path, nil, mode)
+		if err != nil {
+			return nil, err
+		}
+		pkg := pkgs[f.Name.Name]
+		if pkg == nil {
+			pkg = &ast.Package{
+				Name:  f.Name.Name,
+				Files: make(map[string]*ast.File),
+			}
+			pkgs[pkg.Name] = pkg
+		}
+		pkg.Files[path] = f
+	}
+	return pkgs, nil
+}
+
+// otherFiles returns the names of the non-Go source files that the package
+// needs to build, such as assembly and C files.
+func otherFiles(bp *build.Package) []string {
+	var names []string
+	for _, list := range [...][]string{
+		bp.SFiles, bp.CFiles, bp.HFiles, bp.CXXFiles, bp.MFiles,
+		bp.FFiles, bp.SwigFiles, bp.SwigCXXFiles, bp.SysoFiles,
+	} {
+		names = append(names, list...)
+	}
+	return names
+}
+
+// embedFiles returns the files matched by the //go:embed patterns of the
+// package and its tests, relative to the package directory.
+func embedFiles(bp *build.Package) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		name, _ := filepath.Rel(bp.Dir, path)
+		if name = filepath.ToSlash(name); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, list := range [...][]string{bp.EmbedPatterns, bp.TestEmbedPatterns, bp.XTestEmbedPatterns} {
+		for _, pattern := range list {
+			all := strings.HasPrefix(pattern, "all:")
+			pattern = strings.TrimPrefix(pattern, "all:")
+			matches, err := filepath.Glob(filepath.Join(bp.Dir, filepath.FromSlash(pattern)))
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range matches {
+				err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+					if err != nil {
+						return err
+					}
+					base := info.Name()
+					if path != match && !all && (base[0] == '.' || base[0] == '_') {
+						if info.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+					if info.Mode().IsRegular() {
+						add(path)
+					}
+					return nil
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// pkgPath returns the path of a file given relative to the package
+// directory, unless it is absolute.
+func pkgPath(dir, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// copyFile copies a file into a directory, keeping its base name.
+func copyFile(src, dir string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, filepath.Base(src))
+	return ioutil.WriteFile(dst, data, info.Mode().Perm()|0200)
+}
+
+// copyPackage copies the files of a package that the go tool needs to build
+// it into a directory, which is created if needed.
+func copyPackage(bp *build.Package, dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	names := append(bp.GoFiles, bp.CgoFiles...)
+	names = append(names, otherFiles(bp)...)
+	for _, name := range names {
+		if err := copyFile(filepath.Join(bp.Dir, name), dir); err != nil {
+			return err
+		}
+	}
+	embeds, err := embedFiles(bp)
+	if err != nil {
+		return err
+	}
+	for _, name := range embeds {
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return err
+		}
+		if err := copyFile(filepath.Join(bp.Dir, filepath.FromSlash(name)), filepath.Dir(dst)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDir copies a directory tree into dst, such as a module's vendor
+// directory.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0777)
+		}
+		return copyFile(path, filepath.Dir(filepath.Join(dst, rel)))
+	})
+}
@@ -6,22 +6,88 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 )
 
 var (
-	matchStr = flag.String("match", "", "regexp to match the output")
-	shellStr = flag.String("run", "", "shell command to test reductions")
-	verbose  = flag.Bool("v", false, "log applied changes to stderr")
+	opts options
+
+	verbose    = flag.Bool("v", false, "log applied changes to stderr")
+	jsonEvents = flag.Bool("json", false, "write an event per attempted and accepted change to stdout")
 
 	shellStrBuild = `go build -ldflags "-w -s"`
 	shellStrRun   = `go build -ldflags "-w -s" -o out && ./out`
+
+	shellStrSanityBuild = `go build -race -gcflags=all=-d=checkptr -o sanity.out`
+	shellStrSanityTest  = `go test -c -race -gcflags=all=-d=checkptr -o sanity.out`
+	shellStrSanityRun   = `./sanity.out`
 )
 
+// flagOptions registers the flags that configure a reduction in fs, storing
+// their values in opts.
+func flagOptions(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.match, "match", "", "regexp to match the output")
+	fs.StringVar(&opts.notMatch, "notmatch", "", "regexp that the output must not match")
+	fs.StringVar(&opts.run, "run", "", "shell command to test reductions")
+	fs.StringVar(&opts.preset, "preset", "", "preset for -run, -match and -notmatch; see below")
+	fs.StringVar(&opts.test, "test", "", "name of the test to reduce for -preset=test")
+	fs.StringVar(&opts.shell, "shell", "interp", "how to run -run and -diff: interp, sh or argv")
+	fs.StringVar(&opts.diff, "diff", "", "shell command whose output must differ from -run's")
+	fs.BoolVar(&opts.diffOK, "diffok", false, "with -diff, require both commands to succeed")
+	fs.BoolVar(&opts.sanity, "sanity", false, "reject programs with data races or panics first")
+
+	opts.limits.rss.bytes = true
+	opts.limits.size.bytes = true
+	fs.Var(&opts.limits.rss, "rss", "peak memory of a process to reach, like 2GiB or 1.5x")
+	fs.Var(&opts.limits.cpu, "cputime", "total cpu time to reach, like 30s or 2x")
+	fs.Var(&opts.limits.wall, "time", "wall time to reach, like 30s or 2x")
+	fs.Var(&opts.limits.size, "size", "size of -sizefile to reach, like 40MiB or 2x")
+	fs.StringVar(&opts.limits.sizeFile, "sizefile", "out", "output file to measure for -size")
+
+	fs.IntVar(&opts.retries, "retries", 1, "times to run the command on each program")
+	fs.IntVar(&opts.require, "require", 1, "interesting runs required out of -retries")
+
+	fs.StringVar(&opts.panicFunc, "func", "", "function that the panic must originate in")
+	fs.BoolVar(&opts.sameFrames, "frames", false, "require the traceback functions of the original")
+
+	fs.StringVar(&opts.tags, "tags", "", "comma-separated list of build tags")
+	fs.StringVar(&opts.goos, "goos", "", "GOOS to select files and build for")
+	fs.StringVar(&opts.goarch, "goarch", "", "GOARCH to select files and build for")
+	fs.StringVar(&opts.cgo, "cgo", "", "set CGO_ENABLED to 0 or 1")
+	fs.StringVar(&opts.goCmd, "go", "", "go command of the toolchain to use, like ~/go-tip/bin/go")
+
+	fs.Var((*listFlag)(&opts.inputs), "input", "input file to reduce too, relative to dir; can be repeated")
+	fs.StringVar(&opts.fuzz, "fuzz", "", "fuzz corpus entry to reduce, like testdata/fuzz/FuzzFoo/<hash>")
+	fs.BoolVar(&opts.fuzzInline, "fuzzinline", false, "with -fuzz, add a unit test with the reduced values")
+
+	fs.Var((*listFlag)(&opts.env), "env", "NAME=value variable to set for the commands; can be repeated")
+	fs.Var((*listFlag)(&opts.unsetEnv), "unsetenv", "variable to unset for the commands; can be repeated")
+	fs.StringVar(&opts.stdin, "stdin", "", "file to give the commands as stdin, relative to dir")
+	fs.Var((*listFlag)(&opts.files), "file", "extra file to copy next to the package, relative to dir; can be repeated")
+
+	fs.BoolVar(&opts.deps, "deps", false, "copy third-party packages to inline and reduce them too")
+	fs.BoolVar(&opts.stripFirst, "stripfirst", false, "strip comments before reducing the code too")
+}
+
+// listFlag is a flag that can be given multiple times.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
 func init() {
+	flagOptions(flag.CommandLine, &opts)
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr,
-			"Usage: goreduce -match=re [-run=cmd] dir\n")
+			"Usage: goreduce [-match=re] [-run=cmd] dir\n")
+		fmt.Fprintf(os.Stderr,
+			"       goreduce [-match=re] [-run=cmd] -diff=cmd dir\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, `
 If -run=cmd is omitted, the default for non-main packages is:
@@ -33,16 +99,167 @@ And for main packages:
   `+shellStrRun+`
 
 The shell code is run in a Bash-compatible shell interpreter. The
-package being reduced will be in its current directory.
+package being reduced will be in its current directory. To run -run and
+-diff with /bin/sh -c instead, use -shell=sh. With -shell=argv, they are
+split into arguments like a shell would and run directly, which is useful
+to call a script without any quoting.
 
 To catch a run-time error/crash entering main:
 
   goreduce -match 'index out of range' .
 
+If -match is omitted, a regexp is derived from the output of the original
+program, such as the panic message and the function it happened in, or an
+error message without its position. It is printed before reducing.
+
 To catch a build error/crash with custom build flags:
 
   goreduce -match 'internal compiler error' -run 'go build -gcflags "-c=2"' .
 
+To catch a miscompilation, where an optimized build behaves differently:
+
+  goreduce -run 'go run -gcflags=all="-N -l" .' -diff 'go run .' -diffok .
+
+With -diff, a program is kept when the outputs or exit codes of both
+commands differ. If -match is also given, either output must match it.
+
+Reductions can easily introduce undefined behavior, such as data races,
+which make the outputs differ for bogus reasons. With -sanity, each
+program is first run with the race detector and pointer checks, and is
+rejected if it does not build or if it races or panics. For main
+packages, this builds the program with:
+
+  `+shellStrSanityBuild+`
+
+And for non-main packages, which must have tests, it builds the tests:
+
+  `+shellStrSanityTest+`
+
+Then it runs `+shellStrSanityRun+`.
+
+To catch a compiler using too many resources, set a threshold that the
+command must reach instead of a regexp. Memory and time are measured on
+the programs run by the shell, and thresholds ending with "x" are
+relative to the original program:
+
+  goreduce -rss 4GiB -run 'go build' .
+  goreduce -time 0.8x -run 'go build' .
+
+A panic message alone can be too weak, as the reduced program might panic
+elsewhere. With -func, the innermost function in the traceback of the
+goroutine that panicked must be the given one, such as "foo", "main.foo"
+or "(*T).foo". With -frames, all functions in the traceback must be the
+same as in the original program's.
+
+If the program is only interesting some of the time, such as with crashes
+involving goroutines, run the command multiple times on each program. For
+example, to keep programs that crash at least twice out of five runs:
+
+  goreduce -match 'fatal error' -retries 5 -require 2 .
+
+Only the files that match the build context are reduced, which can be set
+with -tags, -goos, -goarch and -cgo. The commands are run with the same
+GOOS, GOARCH, CGO_ENABLED and build tags, to reduce cross-compilation
+crashes. Other source files needed by the package, such as assembly or C
+files, are copied as they are:
+
+  goreduce -preset ice -goos windows -goarch 386 .
+
+To reduce a crash of another toolchain, such as a development build, give
+its go command with -go. It comes first in PATH and sets GOROOT for the
+commands, and it is used to list and type-check packages too. With -v,
+the version of the toolchain in use is printed before reducing:
+
+  goreduce -go ~/go-tip/bin/go -preset ice .
+
+Once the Go code cannot be reduced further, the C preambles above import
+"C" and the assembly files are reduced line by line. Removing the TEXT
+symbol of a function also removes its Go declaration, and vice versa.
+
+Packages of the same module that the package imports are copied along
+with it. When possible, the declarations that it uses from one of them are
+copied into the package, renaming any that clash, and the import is
+dropped. This way, a crash spanning multiple packages ends up in one.
+
+With -deps, the third-party packages imported are copied too, from the
+vendor directory or the module cache, and replaced in the workspace's
+go.mod. They can then be inlined and reduced like the local ones, and the
+requirements that end up unused are removed.
+
+The module's go.mod and go.sum files, as well as any go.work file, are
+copied into the workspace. If the go.mod file is in the package's directory,
+its require, replace and exclude lines are removed one at a time, its go
+directive is lowered, and the unneeded go.sum lines are removed. The
+minimized files are written back along with the code.
+
+Once the code cannot be reduced further, the functions, variables, constants
+and types used from other packages are replaced by local stubs, with the
+same types but no behavior. Imports left unused are then removed, so that
+the program stops depending on large packages where possible.
+
+Compiler directives such as //go:noinline or //go:nosplit are removed one
+at a time, while those of a removed declaration go away with it.
+
+Once nothing else can be removed, ordinary comments are stripped and the
+result is formatted with gofmt. Directives, build constraints and comments
+that the program still needs, such as an example's Output, are kept. Use
+-stripfirst to also strip comments before reducing the code.
+
+The commands inherit the environment, which -env and -unsetenv can change,
+such as to set GODEBUG or GOEXPERIMENT. The -stdin file is given as their
+standard input, and -file copies extra files that they need as they are,
+at the same path relative to the package. These settings are printed at
+the end, as they are needed to reproduce the reduced program:
+
+  goreduce -env GOGC=1 -stdin crash.json -file config.yaml -match 'panic' .
+
+Crashes are often triggered by the data that a program reads, too. Files
+given with -input are reduced by lines and then by bytes, so that both the
+code and its input end up minimal. Files embedded via //go:embed are
+copied and reduced in the same way:
+
+  goreduce -input testdata/crash.json -match 'invalid character' .
+
+To reduce a failure found by Go fuzzing, give the corpus entry that it
+wrote with -fuzz. Each of its values is shrunk, while the default command
+keeps running the fuzz test with that entry:
+
+  go test -count=1 -run '^FuzzFoo$/^<hash>$'
+
+With -fuzzinline, a TestFuzzFooReduced unit test calling the fuzz function
+with the reduced values is added next to the fuzz test at the end.
+
+With -json, a line of JSON is written to stdout for each attempted and
+accepted change, with the rule, the original position, the code or lines
+before and after, the time spent, the tries and the size of the files. This
+helps to follow the progress of a reduction, or to see why it stalls:
+
+  goreduce -json -match 'index out of range' . > events.jsonl
+
+The -preset flag sets -run, -match and -notmatch for common cases, unless
+they are given too. The available presets are:
+
+`+presetUsage()+`
+For example, to reduce a package while its TestFoo test fails:
+
+  goreduce -preset test -test TestFoo .
+
+The interpreter also provides these builtins, so that common commands are
+short and behave the same everywhere:
+
+  goreduce_build [flags]               go build -o out, with the toolchain in use
+  goreduce_timeout duration cmd [args] fail with status 124 if cmd takes longer
+  goreduce_expect regexp cmd [args]    succeed only if cmd's output matches
+  goreduce_cmp file1 file2             succeed only if both files are equal
+
+For example, to keep a program that panics within ten seconds:
+
+  goreduce -run 'goreduce_build && goreduce_timeout 10s goreduce_expect panic ./out' .
+
+Or to keep a package whose builds are not reproducible:
+
+  goreduce -run 'goreduce_build -o a && goreduce_build -o b && ! goreduce_cmp a b' .
+
 Note that you may also call a script or any other program.
 `)
 	}
@@ -51,11 +268,15 @@ Note that you may also call a script or any other program.
 func main() {
 	flag.Parse()
 	args := flag.Args()
-	if len(args) != 1 || *matchStr == "" {
+	if len(args) != 1 {
 		flag.Usage()
 		os.Exit(2)
 	}
-	if err := reduce(args[0], *matchStr, os.Stderr, *shellStr); err != nil {
+	var events io.Writer
+	if *jsonEvents {
+		events = os.Stdout
+	}
+	if err := reduce(args[0], os.Stderr, events, opts); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
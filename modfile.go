@@ -0,0 +1,410 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// goModFile is a go.mod file kept as its lines, so that it can be minimized
+// and written back with its original formatting.
+type goModFile struct {
+	lines   []string
+	removed []bool
+	stmts   []modStmt
+}
+
+// modStmt is a statement of a go.mod file, such as a require line, which may
+// be inside a block like require ( ... ).
+type modStmt struct {
+	verb  string
+	line  int
+	block int // line opening its block, or -1
+}
+
+// fields returns the words of the statement, without the verb or comments.
+func (f *goModFile) fields(st modStmt) []string {
+	text := f.lines[st.line]
+	if i := strings.Index(text, "//"); i >= 0 {
+		text = text[:i]
+	}
+	fields := strings.Fields(text)
+	if st.block < 0 && len(fields) > 0 {
+		fields = fields[1:]
+	}
+	return fields
+}
+
+func parseGoModFile(data []byte) *goModFile {
+	f := &goModFile{lines: splitLines(string(data))}
+	f.removed = make([]bool, len(f.lines))
+	block, blockVerb := -1, ""
+	for i, line := range f.lines {
+		text := line
+		if j := strings.Index(text, "//"); j >= 0 {
+			text = text[:j]
+		}
+		fields := strings.Fields(text)
+		switch {
+		case len(fields) == 0:
+		case block >= 0 && fields[0] == ")":
+			block = -1
+		case block >= 0:
+			f.stmts = append(f.stmts, modStmt{verb: blockVerb, line: i, block: block})
+		case len(fields) == 2 && fields[1] == "(":
+			block, blockVerb = i, fields[0]
+		default:
+			f.stmts = append(f.stmts, modStmt{verb: fields[0], line: i, block: -1})
+		}
+	}
+	return f
+}
+
+// text returns the contents of the file, without the removed statements.
+// Blocks left empty are removed too. If edit is not nil, it may replace the
+// text of each statement that is kept.
+func (f *goModFile) text(edit func(st modStmt, line string) string) string {
+	skip := append([]bool(nil), f.removed...)
+	kept := make(map[int]bool) // blocks with any statements left
+	for _, st := range f.stmts {
+		if !f.removed[st.line] && st.block >= 0 {
+			kept[st.block] = true
+		}
+	}
+	for _, st := range f.stmts {
+		if st.block >= 0 && !kept[st.block] {
+			skip[st.block] = true
+			for i := st.line + 1; i < len(f.lines); i++ {
+				if strings.TrimSpace(f.lines[i]) == ")" {
+					skip[i] = true
+					break
+				}
+			}
+		}
+	}
+	stmtAt := make(map[int]modStmt, len(f.stmts))
+	for _, st := range f.stmts {
+		stmtAt[st.line] = st
+	}
+	var buf bytes.Buffer
+	blank := true // don't start with, or repeat, empty lines
+	for i, line := range f.lines {
+		if skip[i] {
+			continue
+		}
+		if st, ok := stmtAt[i]; ok && edit != nil {
+			line = edit(st, line)
+		}
+		if strings.TrimSpace(line) == "" {
+			if blank {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		buf.WriteString(line)
+	}
+	return strings.TrimRight(buf.String(), "\n") + "\n"
+}
+
+// removeModule removes the require and replace statements for a module,
+// returning a func to undo the removal.
+func (f *goModFile) removeModule(path string) (undo func()) {
+	var lines []int
+	for _, st := range f.stmts {
+		if st.verb != "require" && st.verb != "replace" || f.removed[st.line] {
+			continue
+		}
+		if fields := f.fields(st); len(fields) > 0 && fields[0] == path {
+			f.removed[st.line] = true
+			lines = append(lines, st.line)
+		}
+	}
+	return func() {
+		for _, line := range lines {
+			f.removed[line] = false
+		}
+	}
+}
+
+// removable reports whether a statement may be removed by the reducer.
+func (st modStmt) removable() bool {
+	switch st.verb {
+	case "require", "replace", "exclude", "retract", "toolchain":
+		return true
+	}
+	return false
+}
+
+// absReplace rewrites a replace statement pointing to a relative directory,
+// so that it points to the same directory from the workspace.
+func absReplace(line, root string) string {
+	i := strings.Index(line, "=>")
+	if i < 0 {
+		return line
+	}
+	target := strings.Fields(line[i+2:])
+	if len(target) == 0 {
+		return line
+	}
+	dir := target[0]
+	if !strings.HasPrefix(dir, "./") && !strings.HasPrefix(dir, "../") {
+		return line
+	}
+	abs := filepath.Join(root, filepath.FromSlash(dir))
+	return line[:i+2] + strings.Replace(line[i+2:], dir, strconv.Quote(abs), 1)
+}
+
+var goVersionRe = regexp.MustCompile(`^1\.(\d+)`)
+
+// goStmt returns the go directive of the file, and its version.
+func (f *goModFile) goStmt() (modStmt, string) {
+	for _, st := range f.stmts {
+		if st.verb != "go" {
+			continue
+		}
+		if fields := f.fields(st); len(fields) > 0 {
+			return st, fields[0]
+		}
+	}
+	return modStmt{}, ""
+}
+
+// setGoVersion replaces the version of the go directive.
+func (f *goModFile) setGoVersion(version string) {
+	if st, old := f.goStmt(); old != "" {
+		f.lines[st.line] = strings.Replace(f.lines[st.line], old, version, 1)
+	}
+}
+
+// goSumModules groups the lines of a go.sum file by module path, keeping their
+// order.
+func goSumModules(lines []string) (paths []string, byPath map[string][]string) {
+	byPath = make(map[string][]string)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, ok := byPath[fields[0]]; !ok {
+			paths = append(paths, fields[0])
+		}
+		byPath[fields[0]] = append(byPath[fields[0]], line)
+	}
+	return paths, byPath
+}
+
+// checkGoMod runs the shell command after writing go.mod and go.sum to the
+// workspace, and reports whether the program was still interesting. Changes
+// that the go command makes to go.mod itself, such as adding back a missing
+// requirement, make it fail.
+func (r *reducer) checkGoMod() bool {
+	r.tries++
+	before, _ := ioutil.ReadFile(filepath.Join(r.wdir, "go.mod"))
+	if err := r.writeGoMod(); err != nil {
+		return false
+	}
+	written, err := ioutil.ReadFile(filepath.Join(r.wdir, "go.mod"))
+	if err != nil || r.attempt(filepath.Join(r.dir, "go.mod"), token.Position{}, before, written) != nil {
+		return false
+	}
+	after, err := ioutil.ReadFile(filepath.Join(r.wdir, "go.mod"))
+	return err == nil && bytes.Equal(written, after)
+}
+
+// reduceGoMod minimizes the go.mod and go.sum files of the module, if they
+// are in the package's directory and will be written back. Statements such
+// as requirements are removed one at a time, the go directive is lowered as
+// much as possible, and the unneeded go.sum lines are removed.
+func (r *reducer) reduceGoMod() (anyChanges bool) {
+	f := r.mod.file
+	if f == nil || !r.mod.inDir(r.dir) {
+		return false
+	}
+	pos := func(line int) string {
+		return fmt.Sprintf("%s:%d", filepath.Join(r.dir, "go.mod"), line+1)
+	}
+	defer r.writeGoMod()
+	for _, st := range f.stmts {
+		if !st.removable() || f.removed[st.line] || r.tried[pos(st.line)] {
+			continue
+		}
+		if fields := f.fields(st); st.verb != "exclude" && len(fields) > 0 && r.depMods[fields[0]] != nil {
+			continue // replaced by its copy in the workspace
+		}
+		f.removed[st.line] = true
+		if r.checkGoMod() {
+			r.logGoMod(st.line, "removed %s %s", st.verb, strings.Join(f.fields(st), " "))
+			anyChanges = true
+			continue
+		}
+		f.removed[st.line] = false
+		r.tried[pos(st.line)] = true
+	}
+	if r.lowerGoVersion() {
+		anyChanges = true
+	}
+	if r.mod.sum != nil {
+		paths, byPath := goSumModules(r.mod.sum)
+		orig := r.mod.sum
+		keep := ddmin(len(paths), func(keep []int) bool {
+			lines := []string{}
+			for _, k := range keep {
+				lines = append(lines, byPath[paths[k]]...)
+			}
+			r.mod.sum = lines
+			if r.checkGoMod() {
+				return true
+			}
+			r.mod.sum = orig
+			return false
+		})
+		lines := []string{}
+		for _, k := range keep {
+			lines = append(lines, byPath[paths[k]]...)
+		}
+		r.mod.sum = lines
+		if removed := len(orig) - len(lines); removed > 0 {
+			r.logPos(token.Position{Filename: filepath.Join(r.dir, "go.sum")},
+				"removed %d lines", removed)
+			anyChanges = true
+		}
+	}
+	return anyChanges
+}
+
+// lowerGoVersion finds the lowest go directive that keeps the program
+// interesting, assuming that any version above it works too.
+func (r *reducer) lowerGoVersion() bool {
+	f := r.mod.file
+	st, cur := f.goStmt()
+	m := goVersionRe.FindStringSubmatch(cur)
+	if m == nil {
+		return false
+	}
+	hi, _ := strconv.Atoi(m[1])
+	lo := 11 // the first version with modules
+	best := cur
+	for lo < hi {
+		mid := (lo + hi) / 2
+		version := "1." + strconv.Itoa(mid)
+		if r.tried["go "+version] {
+			lo = mid + 1
+			continue
+		}
+		f.setGoVersion(version)
+		if r.checkGoMod() {
+			best, hi = version, mid
+		} else {
+			r.tried["go "+version] = true
+			lo = mid + 1
+		}
+		f.setGoVersion(best)
+	}
+	if best == cur {
+		return false
+	}
+	r.logGoMod(st.line, "lowered go %s to %s", cur, best)
+	return true
+}
+
+func (r *reducer) logGoMod(line int, format string, a ...interface{}) {
+	r.logPos(token.Position{Filename: filepath.Join(r.dir, "go.mod"), Line: line + 1}, format, a...)
+}
+
+// writeModFiles writes the minimized go.mod and go.sum files back to the
+// package's directory.
+func (r *reducer) writeModFiles() error {
+	f := r.mod.file
+	if f == nil || !r.mod.inDir(r.dir) {
+		return nil
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.mod.root, "go.mod"), []byte(f.text(nil)), 0666); err != nil {
+		return err
+	}
+	if r.mod.sum == nil {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(r.mod.root, "go.sum"), []byte(strings.Join(r.mod.sum, "")), 0666)
+}
+
+// findGoWork returns the go.work file that the go command would use for a
+// module with the given environment, if any.
+func findGoWork(root string, env []string) (string, error) {
+	switch gowork := getEnv(env, "GOWORK"); gowork {
+	case "off":
+		return "", nil
+	case "":
+	default:
+		return gowork, nil
+	}
+	for cur := root; ; {
+		path := filepath.Join(cur, "go.work")
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(cur)
+		if parent == cur {
+			return "", nil
+		}
+		cur = parent
+	}
+}
+
+// copyGoWork copies a go.work file and its go.work.sum into the workspace.
+// The module being reduced is used from the workspace, and the paths to the
+// other modules are made absolute.
+func (r *reducer) copyGoWork(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	work := parseGoModFile(data)
+	src := work.text(func(st modStmt, line string) string {
+		switch st.verb {
+		case "use":
+			fields := work.fields(st)
+			if len(fields) == 0 {
+				return line
+			}
+			use, _ := strconv.Unquote(fields[0])
+			if use == "" {
+				use = fields[0]
+			}
+			abs := use
+			if !filepath.IsAbs(use) {
+				abs = filepath.Join(dir, filepath.FromSlash(use))
+			}
+			if abs == r.mod.root {
+				return strings.Replace(line, fields[0], ".", 1)
+			}
+			return strings.Replace(line, fields[0], strconv.Quote(abs), 1)
+		case "replace":
+			return absReplace(line, dir)
+		}
+		return line
+	})
+	if err := ioutil.WriteFile(filepath.Join(r.wdir, "go.work"), []byte(src), 0666); err != nil {
+		return err
+	}
+	sum, err := ioutil.ReadFile(path + ".sum")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(r.wdir, "go.work.sum"), sum, 0666)
+}
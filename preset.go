@@ -0,0 +1,129 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// preset is a combination of options for a common kind of reduction. The
+// fields are only used if the user did not set the corresponding options.
+type preset struct {
+	desc     string
+	run      string
+	match    string
+	notMatch string
+
+	// needsTest means that run and match contain a %s verb, to be
+	// replaced by the tests given via -test, as a quoted shell word
+	// matching them in run and as a regexp matching their names in match.
+	needsTest bool
+}
+
+var presets = map[string]preset{
+	"ice": {
+		desc:     "internal compiler error",
+		run:      `go build -gcflags=-c=1 -o out`,
+		match:    `internal compiler error`,
+		notMatch: `syntax error|too many errors`,
+	},
+	"vet": {
+		desc:     "go vet crash",
+		run:      `go vet`,
+		match:    `(?m)^panic: |internal error`,
+		notMatch: `(?m)^vet: \S+\.go:\d+`,
+	},
+	"test": {
+		desc:      "failure of the test named by -test",
+		run:       `go test -count=1 -run %s`,
+		match:     `--- FAIL: (?:%s) `,
+		notMatch:  `\[build failed\]|\[setup failed\]|no tests to run`,
+		needsTest: true,
+	},
+	"panic": {
+		desc:     "run-time panic in a main package",
+		run:      shellStrRun,
+		match:    `(?m)^panic: `,
+		notMatch: `(?m)^# `,
+	},
+	"race": {
+		desc:     "data race report in a main package",
+		run:      `go build -race -o out && ./out`,
+		match:    `WARNING: DATA RACE`,
+		notMatch: `(?m)^# `,
+	},
+	"link": {
+		desc:     "linker failure",
+		run:      `go build -o out`,
+		match:    `(?m)^\S*link: |relocation target|undefined reference`,
+		notMatch: `(?m)^\S+\.go:\d+:\d+: `,
+	},
+	"analysis": {
+		desc:     "gopls analysis crash",
+		run:      `gopls check *.go`,
+		match:    `(?m)^panic: |panicked|^bug: `,
+		notMatch: `(?m)^gopls: .*(?:no such file|not found)`,
+	},
+}
+
+// presetUsage returns the list of presets for the help message.
+func presetUsage() string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s := ""
+	for _, name := range names {
+		s += fmt.Sprintf("  %-10s %s\n", name, presets[name].desc)
+	}
+	return s
+}
+
+// applyPreset fills the options that were not set with the values from the
+// preset named by opts.preset.
+func applyPreset(opts *options) error {
+	p, ok := presets[opts.preset]
+	if !ok {
+		return fmt.Errorf("unknown preset: %q", opts.preset)
+	}
+	if p.needsTest {
+		if opts.test == "" {
+			return fmt.Errorf("the %s preset requires -test", opts.preset)
+		}
+		if _, err := testRegexp(opts.test); err != nil {
+			return err
+		}
+		p.run = fmt.Sprintf(p.run, shellQuote("^("+opts.test+")$"))
+		p.match = fmt.Sprintf(p.match, opts.test)
+	}
+	if opts.run == "" {
+		opts.run = p.run
+	}
+	if opts.match == "" {
+		opts.match = p.match
+	}
+	if opts.notMatch == "" {
+		opts.notMatch = p.notMatch
+	}
+	return nil
+}
+
+// testRegexp compiles the regexp given via -test, which matches the names of
+// the tests to keep like go test -run does.
+func testRegexp(test string) (*regexp.Regexp, error) {
+	rx, err := regexp.Compile("^(" + test + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid -test: %v", err)
+	}
+	return rx, nil
+}
+
+// shellQuote quotes s as a single word for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
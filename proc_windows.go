@@ -0,0 +1,17 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcGroup does nothing on Windows.
+func setProcGroup(cmd *exec.Cmd) {}
+
+// killProcGroup only kills the command itself on Windows.
+func killProcGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Signal(os.Kill)
+}
@@ -6,22 +6,29 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"go/ast"
-	"go/importer"
+	"go/format"
 	"go/parser"
 	"go/printer"
 	"go/token"
 	"go/types"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
+	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/interp"
+	shellpkg "mvdan.cc/sh/v3/shell"
 	"mvdan.cc/sh/v3/syntax"
 )
 
@@ -31,20 +38,96 @@ var (
 	fastTest = false
 )
 
+// options holds the parameters of a reduction, usually set via flags.
+type options struct {
+	match    string // regexp to match the output
+	notMatch string // regexp that the output must not match
+	run      string // shell command to test reductions
+
+	preset string // name of a preset to fill the options above
+	test   string // name of the test for the test preset
+
+	diff   string // shell command to compare against run
+	diffOK bool   // with diff, require both commands to succeed
+
+	sanity bool // reject programs that race or panic under -race
+
+	limits limits // resource usage that programs must reach
+
+	retries int // times to run the command on each program
+	require int // runs out of retries that must be interesting
+
+	panicFunc  string // function that the panic must originate from
+	sameFrames bool   // whether to require the original traceback
+
+	tags   string // comma-separated build tags
+	goos   string // GOOS to select files and build for
+	goarch string // GOARCH to select files and build for
+	cgo    string // CGO_ENABLED value, if not the default
+
+	inputs []string // input files to reduce, relative to the package
+
+	fuzz       string // fuzz corpus entry to reduce, relative to the package
+	fuzzInline bool   // add a unit test with the reduced fuzz values
+
+	deps bool // copy third-party packages to inline and reduce them too
+
+	stripFirst bool // strip comments before reducing the code too
+
+	shell string // how to run -run and -diff: interp, sh or argv
+
+	goCmd string // go command of the toolchain to use, if not the one in PATH
+
+	env      []string // NAME=value variables to set for the commands
+	unsetEnv []string // variables to unset for the commands
+	stdin    string   // file to give the commands as stdin, relative to the package
+	files    []string // extra files to copy next to the package, relative to it
+}
+
 type reducer struct {
-	tdir      string
+	wdir      string // workspace, the root of the temporary module
+	tdir      string // package directory within the workspace
+	dir       string // package directory being reduced
+	impPath   string // import path of the package
+	goBin     string // go command, such as "go" or an absolute path
+	env       []string
+	stdin     string // file to give the commands as stdin, if any
 	logOut    io.Writer
 	matchRe   *regexp.Regexp
-	shellProg *syntax.File
+	notRe     *regexp.Regexp
+	shellProg *command
+	diffProg  *command
+	diffOK    bool
+
+	sanityBuild *command
+	sanityRun   *command
+
+	limits    limits
+	usage     usage // resources used by the last command
+	origUsage usage // resources used by the original program
+
+	retries, require int
+
+	panicFunc  string
+	sameFrames bool
+	origFrames []string
 
 	fset     *token.FileSet
 	origFset *token.FileSet
 	pkg      *ast.Package
+	xpkg     *ast.Package // external test package, if any
 	files    []*ast.File
+	xfiles   []*ast.File
 	file     *ast.File
 
 	tconf types.Config
 	info  *types.Info
+	tpkg  *types.Package
+	xtpkg *types.Package
+
+	testRe *regexp.Regexp // tests to keep, as in go test -run
+
+	stripFirst bool // whether to strip comments before the other rules
 
 	useIdents map[types.Object][]*ast.Ident
 	revDefs   map[types.Object]*ast.Ident
@@ -53,6 +136,14 @@ type reducer struct {
 	dstBuf *bytes.Buffer
 
 	tmpFiles map[*ast.File]*os.File
+	goodSrc  map[*ast.File][]byte // last source that was interesting
+	asmFiles []*auxFile
+	inputs   []*auxFile // input files read by the program, or embedded
+	fuzz     *fuzzEntry
+
+	mod     module
+	deps    map[string]*localPkg  // local packages imported, by import path
+	depMods map[string]*depModule // third-party modules copied, with -deps
 
 	tries     int
 	didChange bool
@@ -62,73 +153,348 @@ type reducer struct {
 
 	tried map[string]bool
 
+	events     *json.Encoder  // with -json
+	eventsErr  error          // first error writing the events
+	rule       string         // rule being tried, for the events
+	candPos    token.Position // original position of the node being reduced
+	lastAccept time.Time
+
 	walker
 }
 
 var errNoReduction = fmt.Errorf("could not reduce program")
 
-func reduce(dir, match string, logOut io.Writer, shellStr string) error {
+func reduce(dir string, logOut, events io.Writer, opts options) error {
 	r := &reducer{
-		tdir:   dir,
-		logOut: logOut,
-		tried:  make(map[string]bool, 16),
-		dstBuf: bytes.NewBuffer(nil),
+		logOut:     logOut,
+		diffOK:     opts.diffOK,
+		limits:     opts.limits,
+		retries:    opts.retries,
+		require:    opts.require,
+		panicFunc:  opts.panicFunc,
+		sameFrames: opts.sameFrames,
+		stripFirst: opts.stripFirst,
+		tried:      make(map[string]bool, 16),
+		dstBuf:     bytes.NewBuffer(nil),
+	}
+	if events != nil {
+		r.events = json.NewEncoder(events)
 	}
 	var err error
-	if r.tdir, err = ioutil.TempDir("", "goreduce"); err != nil {
+	if r.wdir, err = ioutil.TempDir("", "goreduce"); err != nil {
+		return err
+	}
+	defer os.RemoveAll(r.wdir)
+	// Mirror the module layout, so that the package keeps its import path
+	// and its external tests can import it.
+	mod, err := findModule(dir)
+	if err != nil {
+		return err
+	}
+	rel, err := mod.rel(dir)
+	if err != nil {
+		return err
+	}
+	r.mod = mod
+	r.impPath = path.Join(mod.path, rel)
+	r.tdir = filepath.Join(r.wdir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(r.tdir, 0777); err != nil {
+		return err
+	}
+	if opts.test != "" {
+		if r.testRe, err = testRegexp(opts.test); err != nil {
+			return err
+		}
+	}
+	userRun := opts.run
+	if opts.preset != "" {
+		if err := applyPreset(&opts); err != nil {
+			return err
+		}
+	}
+	if opts.match != "" {
+		if r.matchRe, err = regexp.Compile(opts.match); err != nil {
+			return err
+		}
+	}
+	if opts.notMatch != "" {
+		if r.notRe, err = regexp.Compile(opts.notMatch); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	// Only reduce the files that the go tool would build with the same
+	// tags and platform, and copy the non-Go files it needs as they are.
+	if opts.cgo != "" && opts.cgo != "0" && opts.cgo != "1" {
+		return fmt.Errorf("-cgo must be 0 or 1, got %q", opts.cgo)
+	}
+	switch opts.shell {
+	case "", "interp", "sh", "argv":
+	default:
+		return fmt.Errorf("-shell must be interp, sh or argv, got %q", opts.shell)
+	}
+	tc, err := findToolchain(opts.goCmd, os.Environ())
+	if err != nil {
+		return err
+	}
+	if *verbose {
+		fmt.Fprintf(r.logOut, "toolchain: %s\n", tc.version)
+	}
+	r.goBin = tc.bin
+	bctx := opts.buildContext()
+	tc.buildContext(&bctx)
+	bp, err := bctx.ImportDir(dir, 0)
+	if err != nil {
+		return err
+	}
+	r.dir = bp.Dir
+	for _, name := range otherFiles(bp) {
+		if err := copyFile(filepath.Join(dir, name), r.tdir); err != nil {
+			return err
+		}
+	}
+	for _, name := range opts.files {
+		name, err := relInput(dir, name)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(r.tdir, filepath.FromSlash(path.Dir(name)))
+		if err := os.MkdirAll(dst, 0777); err != nil {
+			return err
+		}
+		if err := copyFile(filepath.Join(dir, filepath.FromSlash(name)), dst); err != nil {
+			return err
+		}
+	}
+	if opts.stdin != "" {
+		if r.stdin, err = filepath.Abs(pkgPath(dir, opts.stdin)); err != nil {
+			return err
+		}
+		if _, err := os.Stat(r.stdin); err != nil {
+			return err
+		}
+	}
+	// Local packages are needed to build ours, and may be inlined.
+	deps, err := localDeps(bctx, mod, bp, r.impPath)
+	if err != nil {
+		return err
+	}
+	r.deps = make(map[string]*localPkg, len(deps))
+	for _, dep := range deps {
+		dir, _ := mod.pkgDir(dep.ImportPath)
+		rel, err := mod.rel(dir)
+		if err != nil {
+			return err
+		}
+		if err := copyPackage(dep, filepath.Join(r.wdir, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+		r.deps[dep.ImportPath] = &localPkg{bp: dep}
+	}
+	if r.env, err = opts.cmdEnv(tc.env(opts.buildEnv(os.Environ()))); err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(
-		filepath.Join(r.tdir, "go.mod"),
-		[]byte("module tmp"), 0666,
-	); err != nil {
+	if opts.deps {
+		pkgs, mods, err := listDeps(bctx, mod, dir, r.goBin, r.env)
+		if err != nil {
+			return err
+		}
+		if err := r.copyDeps(pkgs, mods); err != nil {
+			return err
+		}
+		r.depMods = mods
+		for _, bp := range pkgs {
+			r.deps[bp.ImportPath] = &localPkg{bp: bp, mod: pkgModule(bp.ImportPath, mods)}
+		}
+		deps = append(deps, pkgs...)
+	}
+	if err := r.writeGoMod(); err != nil {
+		return err
+	}
+	work, err := findGoWork(mod.root, r.env)
+	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(r.tdir)
-	if r.matchRe, err = regexp.Compile(match); err != nil {
+	if work != "" {
+		if err := r.copyGoWork(work); err != nil {
+			return err
+		}
+	}
+	if vdir := filepath.Join(mod.root, "vendor"); !opts.deps {
+		if _, err := os.Stat(vdir); err == nil {
+			if err := copyDir(vdir, filepath.Join(r.wdir, "vendor")); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range bp.SFiles {
+		f, err := readAuxFile(dir, name)
+		if err != nil {
+			return err
+		}
+		r.asmFiles = append(r.asmFiles, f)
+	}
+	for _, name := range opts.inputs {
+		name, err := relInput(dir, name)
+		if err != nil {
+			return err
+		}
+		f, err := readAuxFile(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := r.copyAux(f); err != nil {
+			return err
+		}
+		r.inputs = append(r.inputs, f)
+	}
+	// embedded files are inputs too, but they are always needed
+	embeds, err := embedFiles(bp)
+	if err != nil {
 		return err
 	}
+	for _, name := range embeds {
+		if r.isInput(name) {
+			continue
+		}
+		f, err := readAuxFile(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := r.copyAux(f); err != nil {
+			return err
+		}
+		r.inputs = append(r.inputs, f)
+	}
+	if opts.fuzz != "" {
+		name, err := relInput(dir, opts.fuzz)
+		if err != nil {
+			return err
+		}
+		if r.fuzz, err = readFuzzEntry(dir, name); err != nil {
+			return err
+		}
+		if err := r.copyAux(r.fuzz.file); err != nil {
+			return err
+		}
+		if r.testRe == nil {
+			r.testRe = regexp.MustCompile("^" + regexp.QuoteMeta(r.fuzz.name) + "$")
+		}
+	}
 	r.fset = token.NewFileSet()
-	pkgs, err := parser.ParseDir(r.fset, dir, nil, parser.ParseComments)
+	pkgs, err := parsePackage(r.fset, bp, parser.ParseComments)
 	if err != nil {
 		return err
 	}
-	if len(pkgs) != 1 {
-		return fmt.Errorf("expected 1 package, got %d", len(pkgs))
+	depFiles, err := parseDeps(r.fset, deps, parser.ParseComments)
+	if err != nil {
+		return err
 	}
-	for _, pkg := range pkgs {
-		r.pkg = pkg
+	for i, dep := range deps {
+		r.deps[dep.ImportPath].files = depFiles[i]
+	}
+	for name, pkg := range pkgs {
+		if len(pkgs) == 2 && strings.HasSuffix(name, "_test") {
+			r.xpkg = pkg
+		} else {
+			r.pkg = pkg
+		}
 	}
+	if len(pkgs) > 2 || r.pkg == nil ||
+		(r.xpkg != nil && r.xpkg.Name != r.pkg.Name+"_test") {
+		return fmt.Errorf("expected 1 package, got %d", len(pkgs))
+	}
+	shellStr := opts.run
 	switch {
 	case shellStr != "":
+	case r.fuzz != nil:
+		shellStr = r.fuzz.runCmd()
 	case r.pkg.Name == "main":
 		shellStr = shellStrRun
 	default:
 		shellStr = shellStrBuild
 	}
-	r.shellProg, err = syntax.NewParser().Parse(strings.NewReader(shellStr), "")
+	if shellStr == userRun {
+		r.shellProg, err = parseCmd(opts.shell, shellStr, r.env)
+	} else {
+		// our own commands are written for the interpreter
+		r.shellProg, err = parseShell(shellStr)
+	}
 	if err != nil {
 		return err
 	}
+	if opts.diff != "" {
+		if r.diffProg, err = parseCmd(opts.shell, opts.diff, r.env); err != nil {
+			return err
+		}
+	}
+	if r.retries < 1 {
+		r.retries = 1
+	}
+	if r.require < 1 {
+		r.require = 1
+	}
+	if r.require > r.retries {
+		return fmt.Errorf("cannot require %d interesting runs out of %d",
+			r.require, r.retries)
+	}
+	if opts.sanity {
+		sanityStr := shellStrSanityTest
+		if r.pkg.Name == "main" {
+			sanityStr = shellStrSanityBuild
+		} else if len(bp.TestGoFiles)+len(bp.XTestGoFiles) == 0 {
+			return fmt.Errorf("-sanity needs tests to run in non-main package %s", r.pkg.Name)
+		}
+		if r.sanityBuild, err = parseShell(sanityStr); err != nil {
+			return err
+		}
+		if r.sanityRun, err = parseShell(shellStrSanityRun); err != nil {
+			return err
+		}
+	}
 	r.origFset = token.NewFileSet()
-	parser.ParseDir(r.origFset, dir, nil, 0)
+	parsePackage(r.origFset, bp, 0)
+	// keep the positions of the local packages in sync with r.fset
+	parseDeps(r.origFset, deps, 0)
 
 	var restoreMain func()
 	r.tmpFiles = make(map[*ast.File]*os.File, len(r.pkg.Files))
-	for fpath, file := range r.pkg.Files {
-		r.files = append(r.files, file)
-		tfname := filepath.Join(r.tdir, filepath.Base(fpath))
-		f, err := os.Create(tfname)
-		if err != nil {
-			return err
+	r.goodSrc = make(map[*ast.File][]byte, len(r.pkg.Files))
+	for _, pkg := range r.pkgs() {
+		fpaths := make([]string, 0, len(pkg.Files))
+		for fpath := range pkg.Files {
+			fpaths = append(fpaths, fpath)
 		}
-		if err := rawPrinter.Fprint(f, r.fset, file); err != nil {
-			return err
+		sort.Strings(fpaths)
+		for _, fpath := range fpaths {
+			file := pkg.Files[fpath]
+			if pkg == r.xpkg {
+				r.xfiles = append(r.xfiles, file)
+			} else {
+				r.files = append(r.files, file)
+			}
+			tfname := filepath.Join(r.tdir, filepath.Base(fpath))
+			f, err := os.Create(tfname)
+			if err != nil {
+				return err
+			}
+			r.dstBuf.Reset()
+			if err := rawPrinter.Fprint(r.dstBuf, r.fset, file); err != nil {
+				return err
+			}
+			if _, err := f.Write(r.dstBuf.Bytes()); err != nil {
+				return err
+			}
+			r.tmpFiles[file] = f
+			r.goodSrc[file] = append([]byte(nil), r.dstBuf.Bytes()...)
+			defer f.Close()
 		}
-		r.tmpFiles[file] = f
-		defer f.Close()
 	}
-	r.tconf.Importer = importer.Default()
+	r.tconf.Importer = r.depImporter(newExportImporter(r.goBin, dir, r.env, mod.listFlags()))
+	r.tconf.FakeImportC = true
+	r.tconf.Sizes = types.SizesFor("gc", bctx.GOARCH)
 	r.tconf.Error = func(err error) {
 		if terr, ok := err.(types.Error); ok && terr.Soft {
 			// don't stop type-checking on soft errors
@@ -136,56 +502,202 @@ func reduce(dir, match string, logOut io.Writer, shellStr string) error {
 		}
 		//panic("types.Check should not error here: " + err.Error())
 	}
+	if r.matchRe == nil && r.diffProg == nil && !r.limits.isSet() {
+		if err := r.setDerivedMatch(); err != nil {
+			return err
+		}
+	}
 	// Check that the output matches before we apply any changes
 	if !fastTest {
-		if err := r.checkRun(); err != nil {
+		if err := r.checkOriginal(); err != nil {
 			return err
 		}
 	}
 	r.fillParents()
+	r.lastAccept = time.Now()
 	if anyChanges := r.reduceLoop(); !anyChanges {
 		return errNoReduction
 	}
 	if restoreMain != nil {
 		restoreMain()
 	}
-	for astFile := range r.tmpFiles {
-		astFile.Name.Name = r.pkg.Name
+	final, err := r.formatFiles()
+	if err != nil {
+		return err
+	}
+	for astFile, src := range final {
 		fname := r.fset.Position(astFile.Pos()).Filename
-		f, err := os.Create(fname)
-		if err != nil {
+		if err := ioutil.WriteFile(fname, src, 0666); err != nil {
 			return err
 		}
-		if err := printer.Fprint(f, r.fset, astFile); err != nil {
-			return err
-		}
-		if err := f.Close(); err != nil {
+	}
+	for _, f := range r.auxFiles() {
+		fname := filepath.Join(dir, filepath.FromSlash(f.name))
+		if err := ioutil.WriteFile(fname, []byte(f.String()), 0666); err != nil {
 			return err
 		}
 	}
+	if err := r.writeModFiles(); err != nil {
+		return err
+	}
+	if r.eventsErr != nil {
+		return fmt.Errorf("could not write events: %v", r.eventsErr)
+	}
+	r.report(opts)
+	if opts.fuzzInline && r.fuzz != nil {
+		return r.inlineFuzz()
+	}
 	return nil
 }
 
 func (r *reducer) logChange(node ast.Node, format string, a ...interface{}) {
+	pos := r.origFset.Position(node.Pos())
+	if !pos.IsValid() { // added by us, such as a stub
+		pos.Filename = r.origFset.Position(r.file.Pos()).Filename
+	}
+	r.logPos(pos, format, a...)
+}
+
+// logPos logs a change at a position in the original files.
+func (r *reducer) logPos(pos token.Position, format string, a ...interface{}) {
 	if *verbose {
-		pos := r.origFset.Position(node.Pos())
 		times := "first try"
 		if r.tries != 1 {
 			times = fmt.Sprintf("%d tries", r.tries)
 		}
-		fmt.Fprintf(r.logOut, "%s:%d: %s (%s)\n",
-			pos.Filename, pos.Line, fmt.Sprintf(format, a...), times)
+		fmt.Fprintf(r.logOut, "%s: %s (%s)\n",
+			posString(pos), fmt.Sprintf(format, a...), times)
 	}
+	r.accepted(pos, fmt.Sprintf(format, a...))
 	r.tries = 0
 }
 
+// checkOriginal checks that the original program is interesting. When running
+// the command multiple times, it also estimates how flaky the program is, to
+// let the user know how likely each reduction is to be kept.
+func (r *reducer) checkOriginal() error {
+	if r.retries == 1 {
+		return r.checkRun()
+	}
+	if r.sanityBuild != nil {
+		if err := r.checkSanity(); err != nil {
+			return err
+		}
+	}
+	var firstErr error
+	passed := 0
+	for i := 0; i < r.retries; i++ {
+		if err := r.checkOnce(); err == nil {
+			passed++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	rate := float64(passed) / float64(r.retries)
+	fmt.Fprintf(r.logOut, "original program was interesting in %d of %d runs\n",
+		passed, r.retries)
+	if passed == 0 {
+		return firstErr
+	}
+	if passed < r.require {
+		return fmt.Errorf("original program must be interesting in %d of %d runs:\n%v",
+			r.require, r.retries, firstErr)
+	}
+	if rate < 1 {
+		fmt.Fprintf(r.logOut, "estimated chance to keep a good reduction: %.0f%%\n",
+			100*atLeast(r.require, r.retries, rate))
+	}
+	return nil
+}
+
+// atLeast returns the probability of at least k out of n independent runs
+// succeeding, if each of them succeeds with probability p.
+func atLeast(k, n int, p float64) float64 {
+	total := 0.0
+	for i := k; i <= n; i++ {
+		comb := 1.0
+		for j := 0; j < i; j++ {
+			comb = comb * float64(n-j) / float64(j+1)
+		}
+		total += comb * math.Pow(p, float64(i)) * math.Pow(1-p, float64(n-i))
+	}
+	return total
+}
+
+// checkRun checks whether the current program is interesting, running the
+// command up to r.retries times until r.require runs were interesting.
 func (r *reducer) checkRun() error {
-	out := r.runCmd()
-	if out == nil {
-		return fmt.Errorf("expected an error to occur")
+	if r.sanityBuild != nil {
+		if err := r.checkSanity(); err != nil {
+			return err
+		}
+	}
+	var firstErr error
+	passed := 0
+	for i := 0; i < r.retries; i++ {
+		if err := r.checkOnce(); err == nil {
+			if passed++; passed >= r.require {
+				return nil
+			}
+		} else if firstErr == nil {
+			firstErr = err
+		}
+		if left := r.retries - i - 1; passed+left < r.require {
+			break // not enough runs left
+		}
+	}
+	return firstErr
+}
+
+func (r *reducer) checkOnce() error {
+	if r.diffProg != nil {
+		return r.checkDiff()
+	}
+	out, _ := r.runCmd(r.shellProg)
+	if r.limits.isSet() {
+		if err := r.checkUsage(); err != nil {
+			return err
+		}
+	}
+	if r.matchRe != nil {
+		if out == nil {
+			return fmt.Errorf("expected an error to occur")
+		}
+		if !r.matchRe.Match(out) {
+			return fmt.Errorf("error does not match:\n%s", string(out))
+		}
+	}
+	if r.notRe != nil && r.notRe.Match(out) {
+		return fmt.Errorf("error matches the negative regexp:\n%s", string(out))
+	}
+	return r.checkFrames(out)
+}
+
+// checkDiff runs both shell commands, and succeeds if their outputs or exit
+// statuses differ. This is useful to find miscompilations, as opposed to
+// crashes.
+func (r *reducer) checkDiff() error {
+	out1, err1 := r.runCmd(r.shellProg)
+	if r.limits.isSet() {
+		if err := r.checkUsage(); err != nil {
+			return err
+		}
+	}
+	out2, err2 := r.runCmd(r.diffProg)
+	if r.diffOK && (err1 != nil || err2 != nil) {
+		return fmt.Errorf("expected both commands to succeed:\n%s%s",
+			string(out1), string(out2))
+	}
+	if err1 == err2 && bytes.Equal(out1, out2) {
+		return fmt.Errorf("outputs do not differ:\n%s", string(out1))
 	}
-	if !r.matchRe.Match(out) {
-		return fmt.Errorf("error does not match:\n%s", string(out))
+	if r.matchRe != nil && !r.matchRe.Match(out1) && !r.matchRe.Match(out2) {
+		return fmt.Errorf("neither output matches:\n%s%s",
+			string(out1), string(out2))
+	}
+	if r.notRe != nil && (r.notRe.Match(out1) || r.notRe.Match(out2)) {
+		return fmt.Errorf("an output matches the negative regexp:\n%s%s",
+			string(out1), string(out2))
 	}
 	return nil
 }
@@ -204,24 +716,133 @@ func (r *reducer) okChangeNoUndo() bool {
 	}
 	r.tries++
 	r.tried[newSrc] = true
-	f := r.tmpFiles[r.file]
-	if err := f.Truncate(0); err != nil {
+	if err := r.writeTmp(r.file, r.dstBuf.Bytes()); err != nil {
 		return false
 	}
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
+	fname := r.fset.Position(r.file.Pos()).Filename
+	if err := r.attempt(fname, r.candPos, r.goodSrc[r.file], r.dstBuf.Bytes()); err != nil {
+		// leave the file as it was, as the next change might be
+		// to another file
+		r.writeTmp(r.file, r.goodSrc[r.file])
 		return false
 	}
-	if _, err := f.Write(r.dstBuf.Bytes()); err != nil {
+	// Reduction worked
+	r.goodSrc[r.file] = append([]byte(nil), r.dstBuf.Bytes()...)
+	r.acceptedChange(newSrc)
+	return true
+}
+
+// okChangeFiles is like okChangeNoUndo, for a change to multiple files, such
+// as the uses of an inlined package in all of ours. All of them are written
+// and checked together, and restored if the change is not kept. The first
+// file is the one where the change is made.
+func (r *reducer) okChangeFiles(files ...*ast.File) bool {
+	if r.didChange {
 		return false
 	}
-	if err := r.checkRun(); err != nil {
+	srcs := make([][]byte, len(files))
+	var key bytes.Buffer
+	for i, file := range files {
+		src, err := r.printFile(file)
+		if err != nil {
+			return false
+		}
+		srcs[i] = src
+		key.Write(src)
+	}
+	newSrc := key.String()
+	if r.tried[newSrc] {
 		return false
 	}
-	// Reduction worked
-	r.didChange = true
+	r.tries++
+	r.tried[newSrc] = true
+	restore := func() {
+		for _, file := range files {
+			r.writeTmp(file, r.goodSrc[file])
+		}
+	}
+	for i, file := range files {
+		if err := r.writeTmp(file, srcs[i]); err != nil {
+			restore()
+			return false
+		}
+	}
+	fname := r.fset.Position(files[0].Pos()).Filename
+	if err := r.attempt(fname, r.candPos, r.goodSrc[files[0]], srcs[0]); err != nil {
+		restore()
+		return false
+	}
+	for i, file := range files {
+		r.goodSrc[file] = srcs[i]
+	}
+	r.acceptedChange(newSrc)
 	return true
 }
 
+// acceptedChange records that a change was kept, given the key that it was
+// recorded with in the tried map.
+func (r *reducer) acceptedChange(key string) {
+	r.didChange = true
+	if len(r.tmpFiles)+len(r.auxFiles()) > 1 {
+		// programs that failed with the other files as they were
+		// might not fail now
+		r.tried = make(map[string]bool, len(r.tried))
+		r.tried[key] = true
+	}
+}
+
+// printFile prints an AST file as it would be written to its temporary file.
+func (r *reducer) printFile(file *ast.File) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := rawPrinter.Fprint(&buf, r.fset, file); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeTmp replaces the contents of the temporary file for an AST file.
+func (r *reducer) writeTmp(file *ast.File, src []byte) error {
+	f := r.tmpFiles[file]
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := f.Write(src)
+	return err
+}
+
+// formatFiles returns the final source of the files being reduced, which is
+// gofmt'ed if the program is still interesting that way. Otherwise, as gofmt
+// may sort and regroup imports, it is the source that was last checked.
+func (r *reducer) formatFiles() (map[*ast.File][]byte, error) {
+	final := make(map[*ast.File][]byte, len(r.tmpFiles))
+	changed := false
+	for file := range r.tmpFiles {
+		var buf bytes.Buffer
+		if err := format.Node(&buf, r.fset, file); err != nil {
+			return nil, err
+		}
+		final[file] = buf.Bytes()
+		if !bytes.Equal(buf.Bytes(), r.goodSrc[file]) {
+			changed = true
+			if err := r.writeTmp(file, buf.Bytes()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !changed || r.checkRun() == nil {
+		return final, nil
+	}
+	for file := range r.tmpFiles {
+		if err := r.writeTmp(file, r.goodSrc[file]); err != nil {
+			return nil, err
+		}
+	}
+	return r.goodSrc, nil
+}
+
 func (r *reducer) okChange() bool {
 	if r.okChangeNoUndo() {
 		r.deleteKeepUnderscore = nil
@@ -242,16 +863,49 @@ func (r *reducer) okChange() bool {
 
 func (r *reducer) reduceLoop() (anyChanges bool) {
 	r.info = &types.Info{
-		Defs: make(map[*ast.Ident]types.Object),
-		Uses: make(map[*ast.Ident]types.Object),
+		Defs:      make(map[*ast.Ident]types.Object),
+		Uses:      make(map[*ast.Ident]types.Object),
+		Implicits: make(map[ast.Node]types.Object),
+	}
+	r.typeCheck()
+	r.fillObjs()
+	r.rule = "tests"
+	if r.dropTests() {
+		anyChanges = true
+	}
+	r.rule = "comments"
+	if r.stripFirst && r.stripComments() {
+		anyChanges = true
 	}
 	for {
 		// Update type info after the AST changes
-		r.tconf.Check(r.tdir, r.fset, r.files, r.info)
+		r.typeCheck()
 		r.fillObjs()
 
 		r.didChange = false
-		r.walk(r.pkg, r.reduceNode)
+		// walk each file on its own, as r.file must be the file
+		// containing the nodes being reduced
+		for _, file := range r.allFiles() {
+			r.walk(file, r.reduceNode)
+		}
+		r.candPos = token.Position{}
+		for _, pass := range []struct {
+			rule string
+			fn   func() bool
+		}{
+			{"lines", r.reduceLines},
+			{"stub", r.stubObjs},
+			// comments go last, once they can no longer describe
+			// code that is about to be removed
+			{"comments", r.stripComments},
+			{"requires", r.reduceRequires},
+			{"gomod", r.reduceGoMod},
+		} {
+			r.rule = pass.rule
+			if !r.didChange && pass.fn() {
+				r.didChange = true
+			}
+		}
 		if !r.didChange {
 			if *verbose {
 				fmt.Fprintf(r.logOut, "gave up after %d final tries\n", r.tries)
@@ -262,6 +916,65 @@ func (r *reducer) reduceLoop() (anyChanges bool) {
 	}
 }
 
+// pkgs returns the packages being reduced.
+func (r *reducer) pkgs() []*ast.Package {
+	if r.xpkg != nil {
+		return []*ast.Package{r.pkg, r.xpkg}
+	}
+	return []*ast.Package{r.pkg}
+}
+
+// isInput reports whether a file is already one of the input files.
+func (r *reducer) isInput(name string) bool {
+	for _, f := range r.inputs {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// auxFiles returns the files being reduced that are not Go code.
+func (r *reducer) auxFiles() []*auxFile {
+	files := append(r.asmFiles[:len(r.asmFiles):len(r.asmFiles)], r.inputs...)
+	if r.fuzz != nil {
+		files = append(files, r.fuzz.file)
+	}
+	return files
+}
+
+// allFiles returns the files being reduced, sorted by name.
+func (r *reducer) allFiles() []*ast.File {
+	return append(r.files[:len(r.files):len(r.files)], r.xfiles...)
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+// typeCheck updates the type information after the AST changes. The external
+// test package, if any, is checked separately and imports the package that it
+// tests.
+func (r *reducer) typeCheck() {
+	r.tpkg, _ = r.tconf.Check(r.impPath, r.fset, r.files, r.info)
+	if r.xpkg == nil {
+		return
+	}
+	xconf := r.tconf
+	xconf.Importer = importerFunc(func(path string) (*types.Package, error) {
+		if path == r.impPath {
+			return r.tpkg, nil
+		}
+		return r.tconf.Importer.Import(path)
+	})
+	r.xtpkg, _ = xconf.Check(r.impPath+"_test", r.fset, r.xfiles, r.info)
+}
+
+// ownPkg reports whether pkg is one of the packages being reduced.
+func (r *reducer) ownPkg(pkg *types.Package) bool {
+	return pkg != nil && (pkg == r.tpkg || pkg == r.xtpkg)
+}
+
 func (r *reducer) fillObjs() {
 	r.revDefs = make(map[types.Object]*ast.Ident, len(r.info.Defs))
 	for id, obj := range r.info.Defs {
@@ -272,7 +985,7 @@ func (r *reducer) fillObjs() {
 	}
 	r.useIdents = make(map[types.Object][]*ast.Ident, len(r.info.Uses)/2)
 	for id, obj := range r.info.Uses {
-		if pkg := obj.Pkg(); pkg == nil || pkg.Name() != r.pkg.Name {
+		if !r.ownPkg(obj.Pkg()) {
 			// builtin or declared outside of our pkg
 			continue
 		}
@@ -283,25 +996,111 @@ func (r *reducer) fillObjs() {
 func (r *reducer) fillParents() {
 	r.parents = make(map[ast.Node]ast.Node)
 	stack := make([]ast.Node, 1, 32)
-	ast.Inspect(r.pkg, func(node ast.Node) bool {
-		if node == nil {
-			stack = stack[:len(stack)-1]
+	for _, pkg := range r.pkgs() {
+		ast.Inspect(pkg, func(node ast.Node) bool {
+			if node == nil {
+				stack = stack[:len(stack)-1]
+				return true
+			}
+			r.parents[node] = stack[len(stack)-1]
+			stack = append(stack, node)
 			return true
+		})
+	}
+}
+
+var sanityRe = regexp.MustCompile(`(?m)^(WARNING: DATA RACE|panic: |fatal error: )`)
+
+// checkSanity builds the program or its tests with the race detector, and
+// fails if they do not build or if running them reported a data race or a
+// panic. Other failures are fine, as the program may well be meant to fail.
+func (r *reducer) checkSanity() error {
+	if out, err := r.runCmd(r.sanityBuild); err != nil {
+		return fmt.Errorf("sanity build failed:\n%s", string(out))
+	}
+	if out, _ := r.runCmd(r.sanityRun); sanityRe.Match(out) {
+		return fmt.Errorf("sanity check failed:\n%s", string(out))
+	}
+	return nil
+}
+
+// command is a shell command run on each program. It is either a program for
+// the embedded interpreter, or the arguments to run directly.
+type command struct {
+	prog *syntax.File
+	argv []string
+}
+
+func parseShell(src string) (*command, error) {
+	prog, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		return nil, err
+	}
+	return &command{prog: prog}, nil
+}
+
+// parseCmd parses a command given by the user, to be run as the -shell
+// option says: by the embedded interpreter, by /bin/sh, or as arguments split
+// like a shell would, expanding variables from env.
+func parseCmd(shell, src string, env []string) (*command, error) {
+	switch shell {
+	case "sh":
+		return &command{argv: []string{"/bin/sh", "-c", src}}, nil
+	case "argv":
+		argv, err := shellpkg.Fields(src, func(name string) string {
+			return getEnv(env, name)
+		})
+		if err != nil {
+			return nil, err
 		}
-		r.parents[node] = stack[len(stack)-1]
-		stack = append(stack, node)
-		return true
-	})
+		if len(argv) == 0 {
+			return nil, fmt.Errorf("empty command: %q", src)
+		}
+		return &command{argv: argv}, nil
+	}
+	return parseShell(src)
 }
 
-func (r *reducer) runCmd() []byte {
+// runCmd runs a command in the temporary directory, returning its combined
+// output and its exit status as an error. The resources it used are recorded
+// in r.usage.
+func (r *reducer) runCmd(cmd *command) ([]byte, error) {
+	ctx := context.TODO()
 	var buf bytes.Buffer
-	runner, err := interp.New(interp.Dir(r.tdir), interp.StdIO(nil, &buf, &buf))
+	// A file rather than a reader, so that the commands that don't read
+	// it, such as go build, don't consume it either.
+	var stdin io.Reader
+	if r.stdin != "" {
+		f, err := os.Open(r.stdin)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		stdin = f
+	}
+	if cmd.prog == nil {
+		r.usage = usage{}
+		start := time.Now()
+		err := r.runArgv(ctx, cmd.argv, stdin, &buf)
+		r.usage.wall = time.Since(start)
+		r.measureSize()
+		return buf.Bytes(), err
+	}
+	runner, err := interp.New(
+		interp.Dir(r.tdir),
+		interp.Env(expand.ListEnviron(r.env...)),
+		interp.StdIO(stdin, &buf, &buf),
+		interp.WithExecModules(r.execModule),
+	)
 	if err != nil {
 		panic(err)
 	}
-	runner.Run(context.TODO(), r.shellProg)
-	return buf.Bytes()
+	r.usage = usage{}
+	start := time.Now()
+	err = runner.Run(ctx, cmd.prog)
+	r.usage.wall = time.Since(start)
+	r.measureSize()
+	return buf.Bytes(), err
 }
 
 func (r *reducer) exprRef(expr ast.Expr) *ast.Expr {
@@ -351,3 +1150,58 @@ func (r *reducer) stmtRef(stmt ast.Stmt) *ast.Stmt {
 	}
 	return nil
 }
+
+var posType = reflect.TypeOf(token.NoPos)
+
+// copyNode returns a deep copy of a node, which can be changed without
+// affecting the original. Positions are mapped with pos if it is not nil,
+// and identifiers keep their objects. The copy of each node reached is
+// recorded in copies, so that a node reached twice is copied once.
+func copyNode(node ast.Node, pos func(token.Pos) token.Pos, copies map[interface{}]interface{}) ast.Node {
+	var cp func(v reflect.Value) reflect.Value
+	cp = func(v reflect.Value) reflect.Value {
+		switch v.Kind() {
+		case reflect.Ptr:
+			if v.IsNil() {
+				return v
+			}
+			if _, ok := v.Interface().(*ast.Object); ok {
+				return v
+			}
+			if done, ok := copies[v.Interface()]; ok {
+				return reflect.ValueOf(done)
+			}
+			c := reflect.New(v.Type().Elem())
+			copies[v.Interface()] = c.Interface()
+			c.Elem().Set(cp(v.Elem()))
+			return c
+		case reflect.Struct:
+			c := reflect.New(v.Type()).Elem()
+			for i := 0; i < v.NumField(); i++ {
+				c.Field(i).Set(cp(v.Field(i)))
+			}
+			return c
+		case reflect.Slice:
+			if v.IsNil() {
+				return v
+			}
+			c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+			for i := 0; i < v.Len(); i++ {
+				c.Index(i).Set(cp(v.Index(i)))
+			}
+			return c
+		case reflect.Interface:
+			if v.IsNil() {
+				return v
+			}
+			c := reflect.New(v.Type()).Elem()
+			c.Set(cp(v.Elem()))
+			return c
+		}
+		if v.Type() == posType && pos != nil {
+			return reflect.ValueOf(pos(token.Pos(v.Int())))
+		}
+		return v
+	}
+	return cp(reflect.ValueOf(node)).Interface().(ast.Node)
+}
@@ -5,12 +5,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -21,6 +28,7 @@ var (
 func TestMain(m *testing.M) {
 	flag.Parse()
 	fastTest = *fast
+	*verbose = true
 	os.Exit(m.Run())
 }
 
@@ -29,7 +37,6 @@ func TestReductions(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	*verbose = true
 	for _, path := range paths {
 		name := filepath.Base(path)
 		t.Run(name, testReduction(name))
@@ -44,6 +51,27 @@ func readFile(t testing.TB, dir, path string) string {
 	return string(bs)
 }
 
+// readOptions returns the options for a test reduction, reading the regexp
+// from the match file and any extra flags from the flags file, one per line.
+func readOptions(t testing.TB, dir string) options {
+	var opts options
+	if _, err := os.Stat(filepath.Join(dir, "flags")); err == nil {
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		flagOptions(fs, &opts)
+		args := strings.Split(readFile(t, dir, "flags"), "\n")
+		for len(args) > 0 && args[len(args)-1] == "" {
+			args = args[:len(args)-1]
+		}
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "match")); err == nil {
+		opts.match = strings.TrimRight(readFile(t, dir, "match"), "\n")
+	}
+	return opts
+}
+
 func writeFile(t testing.TB, dir, path, cont string) {
 	err := ioutil.WriteFile(filepath.Join(dir, path), []byte(cont), 0644)
 	if err != nil {
@@ -55,22 +83,49 @@ func testReduction(name string) func(*testing.T) {
 	return func(t *testing.T) {
 		t.Parallel()
 		dir := filepath.Join("testdata", name)
-		orig := []byte(readFile(t, dir, "src.go"))
-		defer ioutil.WriteFile(filepath.Join(dir, "src.go"), orig, 0644)
-		want := readFile(t, dir, "src.go.min")
-		match := strings.TrimRight(readFile(t, dir, "match"), "\n")
+		// each file being reduced, such as src.go, has its wanted
+		// output in a file with the .min suffix, such as src.go.min
+		var fnames []string
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !strings.HasSuffix(path, ".min") {
+				return err
+			}
+			fnames = append(fnames, strings.TrimSuffix(path, ".min"))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fname := range fnames {
+			orig, err := ioutil.ReadFile(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ioutil.WriteFile(fname, orig, 0644)
+		}
+		opts := readOptions(t, dir)
 		impPath := "./testdata/" + name
 		var buf bytes.Buffer
-		if err := reduce(impPath, match, &buf, ""); err != nil {
+		// a dir with an events file checks the events written with -json
+		var events io.Writer
+		var eventsBuf bytes.Buffer
+		if _, err := os.Stat(filepath.Join(dir, "events")); err == nil {
+			events = &eventsBuf
+		}
+		if err := reduce(impPath, &buf, events, opts); err != nil {
 			t.Fatal(err)
 		}
-		got := readFile(t, dir, "src.go")
-		if want != got {
-			if *write {
-				writeFile(t, dir, "src.go.min", got)
-			} else {
-				t.Fatalf("unexpected program output\nwant:\n%sgot:\n%s",
-					want, got)
+		for _, fname := range fnames {
+			base, _ := filepath.Rel(dir, fname)
+			want := readFile(t, dir, base+".min")
+			got := readFile(t, dir, base)
+			if want != got {
+				if *write {
+					writeFile(t, dir, base+".min", got)
+				} else {
+					t.Fatalf("unexpected %s output\nwant:\n%sgot:\n%s",
+						base, want, got)
+				}
 			}
 		}
 		// remove testdata/<dir>/ bit
@@ -80,6 +135,9 @@ func testReduction(name string) func(*testing.T) {
 			if line == "" {
 				break
 			}
+			if strings.HasPrefix(line, "toolchain: ") {
+				continue // depends on the go in PATH; see TestToolchain
+			}
 			line = strings.TrimPrefix(line, dir+string(filepath.Separator))
 			buf.WriteString(line)
 			buf.WriteByte('\n')
@@ -94,9 +152,43 @@ func testReduction(name string) func(*testing.T) {
 					wantLog, gotLog)
 			}
 		}
+		if events == nil {
+			return
+		}
+		gotEvents := stableEvents(t, dir, &eventsBuf)
+		wantEvents := readFile(t, dir, "events")
+		if wantEvents != gotEvents {
+			if *write {
+				writeFile(t, dir, "events", gotEvents)
+			} else {
+				t.Fatalf("unexpected events\nwant:\n%sgot:\n%s",
+					wantEvents, gotEvents)
+			}
+		}
 	}
 }
 
+// stableEvents decodes the events written by a reduction and encodes them
+// again without the durations and the testdata/<dir>/ bit, so that they can
+// be compared.
+func stableEvents(t *testing.T, dir string, r io.Reader) string {
+	var buf bytes.Buffer
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(&buf)
+	for dec.More() {
+		var ev event
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		ev.Pos = strings.TrimPrefix(ev.Pos, dir+string(filepath.Separator))
+		ev.Duration = 0
+		if err := enc.Encode(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String()
+}
+
 func BenchmarkReduce(b *testing.B) {
 	dir, err := ioutil.TempDir("", "goreduce")
 	if err != nil {
@@ -119,7 +211,7 @@ func Crasher() {
 		if err := ioutil.WriteFile("src.go", orig, 0644); err != nil {
 			b.Fatal(err)
 		}
-		err := reduce(".", "index out of range", ioutil.Discard, "")
+		err := reduce(".", ioutil.Discard, nil, options{match: "index out of range"})
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -131,18 +223,117 @@ func TestReduceErrs(t *testing.T) {
 	fastTest = false
 	defer func() { fastTest = *fast }()
 	tests := [...]struct {
-		dir, match string
-		errCont    string
+		dir     string
+		opts    options
+		errCont string
 	}{
-		{"missing-dir", "[", "missing closing ]"},
-		{"missing-dir", ".", "no such file"},
-		{"testdata/remove-stmt", "no-match", "does not match"},
+		{"missing-dir", options{match: "["}, "missing closing ]"},
+		{"missing-dir", options{match: "."}, "no such file"},
+		{"testdata/remove-stmt", options{run: "true"}, "could not derive"},
+		{"testdata/remove-stmt", options{match: "panic", panicFunc: "foo"}, "did not originate in foo"},
+		{"testdata/panic-method", options{match: "panic", panicFunc: "(*T).crash"}, "did not originate in (*T).crash"},
+		{"testdata/remove-stmt", options{match: "panic", notMatch: "panic: 0"}, "negative regexp"},
+		{"testdata/remove-stmt", options{match: "panic", cgo: "yes"}, "must be 0 or 1"},
+		{"testdata/remove-stmt", options{match: "panic", goos: "foo"}, "does not match"},
+		{"testdata/remove-stmt", options{goCmd: "missing-go"}, "executable file not found"},
+		{"testdata/remove-stmt", options{run: "true", shell: "bash"}, "-shell must be"},
+		{"testdata/remove-stmt", options{match: "panic", shell: "bash"}, "-shell must be"},
+		{"testdata/remove-stmt", options{inputs: []string{"../log"}}, "not within"},
+		{"testdata/remove-stmt", options{inputs: []string{"missing"}}, "no such file"},
+		{"testdata/remove-stmt", options{match: "panic", files: []string{"../log"}}, "not within"},
+		{"testdata/remove-stmt", options{fuzz: "src.go"}, "not a fuzz corpus file"},
+		{"testdata/remove-stmt", options{preset: "foo"}, "unknown preset"},
+		{"testdata/remove-stmt", options{preset: "test"}, "requires -test"},
+		{"testdata/remove-stmt", options{preset: "test", test: "Test("}, "invalid -test"},
+		{"testdata/remove-stmt", options{match: "panic", test: "Test("}, "invalid -test"},
+		{"testdata/remove-stmt", options{preset: "ice"}, "does not match"},
+		{"testdata/remove-stmt", options{match: "no-match"}, "does not match"},
+		{"testdata/remove-stmt", options{run: "echo foo", diff: "echo foo"}, "do not differ"},
+		{"testdata/remove-stmt", options{diff: "echo", diffOK: true}, "both commands to succeed"},
+		{"testdata/remove-stmt", options{match: "panic", sanity: true}, "sanity check failed"},
+		{"testdata/remove-stmt", options{
+			run:     "if [ -e ran ]; then rm ran; else touch ran; go run .; fi",
+			match:   "panic: 0",
+			retries: 2,
+			require: 2,
+		}, "must be interesting in 2 of 2 runs"},
+		{"testdata/inline-pkg-files/helper", options{match: ".", sanity: true}, "needs tests"},
+		{"testdata/remove-stmt", options{limits: limits{
+			wall: threshold{amount: float64(time.Hour)},
+		}}, "wall time"},
 	}
 	for _, tc := range tests {
-		err := reduce(tc.dir, tc.match, ioutil.Discard, "")
+		err := reduce(tc.dir, ioutil.Discard, nil, tc.opts)
 		if err == nil || !strings.Contains(err.Error(), tc.errCont) {
 			t.Fatalf("wanted error conatining %q, got: %v",
 				tc.errCont, err)
 		}
 	}
 }
+
+func TestToolchain(t *testing.T) {
+	t.Parallel()
+	bin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip(err)
+	}
+	if bin, err = filepath.Abs(bin); err != nil {
+		t.Fatal(err)
+	}
+	output := func(args ...string) string {
+		out, err := exec.Command(bin, args...).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	goroot := output("env", "GOROOT")
+	version := output("version")
+
+	dir, err := ioutil.TempDir("", "goreduce-toolchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "go.mod", "module foo.com/bar\n")
+	writeFile(t, dir, "src.go", `package main
+
+func main() {
+	var _ = "foo"
+	panic(0)
+}
+`)
+	var buf bytes.Buffer
+	err = reduce(dir, &buf, nil, options{
+		goCmd: bin,
+		run:   `echo "GOROOT=$GOROOT GOTOOLCHAIN=$GOTOOLCHAIN"; go build -o out && ./out`,
+		match: `(?s)^GOROOT=` + regexp.QuoteMeta(goroot) + ` GOTOOLCHAIN=local\n.*panic: 0`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// logged with -v, which TestMain sets
+	if want := "toolchain: " + version + "\n"; !strings.HasPrefix(buf.String(), want) {
+		t.Fatalf("wanted log starting with %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestRunArgvCancel(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("no process groups on Windows")
+	}
+	r := &reducer{env: os.Environ(), tdir: t.TempDir()}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// the background sleep keeps the output open unless it is killed too
+	start := time.Now()
+	var out bytes.Buffer
+	err := r.runArgv(ctx, []string{"sh", "-c", "sleep 30 & sleep 30"}, nil, &out)
+	if err == nil {
+		t.Fatal("wanted an error from a cancelled command")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("cancelled command took %v", d)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// threshold is an amount of a resource that a program must reach to be
+// interesting. It is either absolute, or a ratio of what the original program
+// used, as in "1.5x".
+type threshold struct {
+	amount float64
+	ratio  bool
+
+	bytes bool // whether amount is in bytes, or a time.Duration
+}
+
+func (t *threshold) String() string {
+	switch {
+	case t == nil || t.amount == 0:
+		return ""
+	case t.ratio:
+		return strconv.FormatFloat(t.amount, 'g', -1, 64) + "x"
+	case t.bytes:
+		return formatBytes(int64(t.amount))
+	}
+	return time.Duration(t.amount).String()
+}
+
+func (t *threshold) Set(s string) error {
+	if num := strings.TrimSuffix(s, "x"); num != s {
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return err
+		}
+		t.amount, t.ratio = f, true
+		return nil
+	}
+	t.ratio = false
+	if t.bytes {
+		n, err := parseBytes(s)
+		t.amount = float64(n)
+		return err
+	}
+	d, err := time.ParseDuration(s)
+	t.amount = float64(d)
+	return err
+}
+
+// reached reports whether used reaches the threshold, given the amount that the
+// original program used. A threshold that was never set is always reached.
+func (t *threshold) reached(used, orig int64) bool {
+	if t.ratio {
+		return float64(used) >= t.amount*float64(orig)
+	}
+	return float64(used) >= t.amount
+}
+
+func (t *threshold) isSet() bool { return t.amount > 0 }
+
+var byteUnits = [...]string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+// parseBytes parses a number of bytes with an optional binary unit suffix, such
+// as "512M", "2GB" or "1.5GiB".
+func parseBytes(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(s, "B"), "i")
+	mult := 1.0
+	if i := len(num) - 1; i >= 0 {
+		if j := strings.IndexByte("KMGT", num[i]); j >= 0 {
+			num = num[:i]
+			mult = float64(int64(1) << (10 * uint(j+1)))
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(f * mult), nil
+}
+
+func formatBytes(n int64) string {
+	f := float64(n)
+	unit := 0
+	for f >= 1024 && unit < len(byteUnits)-1 {
+		f /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%s", f, byteUnits[unit])
+}
+
+// limits holds the resource thresholds that a program must reach.
+type limits struct {
+	rss  threshold // peak memory of a single process
+	cpu  threshold // user and system time, added up
+	wall threshold // wall time of the shell command
+
+	size     threshold // size of sizeFile after running the command
+	sizeFile string
+}
+
+func (l *limits) isSet() bool {
+	return l.rss.isSet() || l.cpu.isSet() || l.wall.isSet() || l.size.isSet()
+}
+
+func (l *limits) anyRatio() bool {
+	return l.rss.ratio || l.cpu.ratio || l.wall.ratio || l.size.ratio
+}
+
+// measureSize records the size of the output file after running a command,
+// and removes it so that a later command failing to produce it cannot reuse
+// its size.
+func (r *reducer) measureSize() {
+	r.usage.size = 0
+	if !r.limits.size.isSet() {
+		return
+	}
+	path := filepath.Join(r.tdir, r.limits.sizeFile)
+	if info, err := os.Stat(path); err == nil {
+		r.usage.size = info.Size()
+		os.Remove(path)
+	}
+}
+
+// checkUsage fails if the last command run did not reach all of the resource
+// thresholds.
+func (r *reducer) checkUsage() error {
+	l, u, orig := &r.limits, r.usage, r.origUsage
+	if l.anyRatio() && orig == (usage{}) {
+		// The first command to run is on the original program.
+		r.origUsage = u
+		if *verbose {
+			fmt.Fprintf(r.logOut, "original usage: %s memory, %s cpu, %s wall, %s size\n",
+				formatBytes(u.maxRSS), u.cpu, u.wall, formatBytes(u.size))
+		}
+		return nil
+	}
+	switch {
+	case l.rss.isSet() && !l.rss.reached(u.maxRSS, orig.maxRSS):
+		return fmt.Errorf("peak memory %s did not reach %s",
+			formatBytes(u.maxRSS), l.rss.String())
+	case l.cpu.isSet() && !l.cpu.reached(int64(u.cpu), int64(orig.cpu)):
+		return fmt.Errorf("cpu time %s did not reach %s",
+			u.cpu, l.cpu.String())
+	case l.wall.isSet() && !l.wall.reached(int64(u.wall), int64(orig.wall)):
+		return fmt.Errorf("wall time %s did not reach %s",
+			u.wall, l.wall.String())
+	case l.size.isSet() && !l.size.reached(u.size, orig.size):
+		return fmt.Errorf("size of %s %s did not reach %s", l.sizeFile,
+			formatBytes(u.size), l.size.String())
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import "os"
+
+// maxRSS is not supported on Windows.
+func maxRSS(ps *os.ProcessState) int64 { return 0 }
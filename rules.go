@@ -11,6 +11,8 @@ import (
 	"go/types"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // uses interface{} instead of ast.Node for node slices
@@ -18,6 +20,14 @@ func (r *reducer) reduceNode(v interface{}) bool {
 	if r.didChange {
 		return false
 	}
+	switch x := v.(type) {
+	case ast.Node:
+		r.rule = strings.TrimPrefix(fmt.Sprintf("%T", v), "*ast.")
+		r.candPos = r.origFset.Position(x.Pos())
+	case *[]ast.Stmt:
+		r.rule = "StmtList"
+		r.candPos = r.origFset.Position((*x)[0].Pos())
+	}
 	if expr, ok := v.(ast.Expr); ok {
 		rsExpr := r.resolveExpr(v.(ast.Expr))
 		switch rsExpr {
@@ -34,12 +44,16 @@ func (r *reducer) reduceNode(v interface{}) bool {
 	case *ast.File:
 		r.file = x
 		// put the original src for the file in the tried map
+		r.dstBuf.Reset()
 		if err := rawPrinter.Fprint(r.dstBuf, r.fset, r.file); err != nil {
 			return false
 		}
 		newSrc := r.dstBuf.String()
 		r.tried[newSrc] = true
 	case *ast.ValueSpec:
+		if r.removeDirectives(r.specDoc(x)) {
+			break
+		}
 		for _, name := range x.Names {
 			if ast.IsExported(name.Name) {
 				return true
@@ -49,6 +63,7 @@ func (r *reducer) reduceNode(v interface{}) bool {
 			}
 		}
 		undo := r.removeSpec(x)
+		r.afterDelete(x)
 		if r.okChange() {
 			r.mergeLines(x.Pos(), x.End()+1)
 			gd := r.parents[x].(*ast.GenDecl)
@@ -62,6 +77,9 @@ func (r *reducer) reduceNode(v interface{}) bool {
 		}
 	case *ast.ImportSpec:
 		if x.Name == nil || x.Name.Name != "_" { // used
+			if r.inlinePkg(x) {
+				r.logChange(x, "inlined package %s", x.Path.Value)
+			}
 			return false
 		}
 		undo := r.removeSpec(x)
@@ -124,6 +142,9 @@ func (r *reducer) reduceNode(v interface{}) bool {
 			break
 		}
 		declIdent := r.revDefs[obj]
+		if declIdent == nil || !r.inFile(declIdent) {
+			break
+		}
 		gd, _ := r.parents[r.parents[declIdent]].(*ast.GenDecl)
 		isVar := gd == nil || gd.Tok == token.VAR
 		val := r.declIdentValue(declIdent)
@@ -208,6 +229,15 @@ func (r *reducer) reduceNode(v interface{}) bool {
 			r.logChange(x, "inlined call")
 		}
 	case *ast.FuncDecl:
+		if r.removeDirectives(x.Doc) {
+			break
+		}
+		if x.Body == nil {
+			if r.removeAsmFunc(x) {
+				r.logChange(x, "removed asm func %s", x.Name.Name)
+			}
+			break
+		}
 		if x.Recv == nil || len(x.Recv.List) != 1 {
 			break
 		}
@@ -439,30 +469,40 @@ func (r *reducer) funcDetails(fun ast.Expr) (*ast.FuncType, *ast.BlockStmt) {
 		return x.Type, x.Body
 	case *ast.Ident:
 		obj := r.info.Uses[x]
-		if pkg := obj.Pkg(); pkg == nil || pkg.Name() != r.pkg.Name {
+		if !r.ownPkg(obj.Pkg()) {
 			break
 		}
 		declId := r.revDefs[obj]
+		if declId == nil || !r.inFile(declId) {
+			// only the current file is written after a change
+			break
+		}
 		if fd, _ := r.parents[declId].(*ast.FuncDecl); fd != nil {
 			return fd.Type, fd.Body
 		}
-		fl := r.declIdentValue(declId).(*ast.FuncLit)
-		return fl.Type, fl.Body
+		if fl, _ := r.declIdentValue(declId).(*ast.FuncLit); fl != nil {
+			return fl.Type, fl.Body
+		}
 	}
 	return nil, nil
 }
 
+// inFile reports whether node is in the file being reduced.
+func (r *reducer) inFile(node ast.Node) bool {
+	return r.fset.File(node.Pos()) == r.fset.File(r.file.Pos())
+}
+
 func (r *reducer) declIdentValue(id *ast.Ident) ast.Expr {
 	switch y := r.parents[id].(type) {
 	case *ast.ValueSpec:
 		for i, name := range y.Names {
-			if name == id {
+			if name == id && i < len(y.Values) {
 				return y.Values[i]
 			}
 		}
 	case *ast.AssignStmt:
 		for i, name := range y.Lhs {
-			if name == id {
+			if name == id && len(y.Lhs) == len(y.Rhs) {
 				return y.Rhs[i]
 			}
 		}
@@ -496,8 +536,8 @@ func (r *reducer) removeDecl(id *ast.Ident) (undo func()) {
 		oldAssgn := *x
 		for i, left := range x.Lhs {
 			if left == id {
-				x.Lhs = append(x.Lhs[:i], x.Lhs[i+1:]...)
-				x.Rhs = append(x.Rhs[:i], x.Rhs[i+1:]...)
+				x.Lhs = append(x.Lhs[:i:i], x.Lhs[i+1:]...)
+				x.Rhs = append(x.Rhs[:i:i], x.Rhs[i+1:]...)
 				break
 			}
 		}
@@ -531,10 +571,18 @@ func (r *reducer) fixAssignTokParent(declIdent *ast.Ident) {
 
 func (r *reducer) removeSpec(spec ast.Spec) (undo func()) {
 	gd := r.parents[spec].(*ast.GenDecl)
+	// directives such as //go:embed must go away with the spec, from the
+	// file that has it, which is not r.file for the imports of other files
+	doc := r.specDoc(spec)
+	file := r.file
+	if f, _ := r.parents[gd].(*ast.File); f != nil {
+		file = f
+	}
+	undoDoc := removeFileDoc(file, doc)
 	oldSpecs := gd.Specs
 	for i, sp := range oldSpecs {
 		if sp == spec {
-			gd.Specs = append(gd.Specs[:i], gd.Specs[i+1:]...)
+			gd.Specs = append(gd.Specs[:i:i], gd.Specs[i+1:]...)
 			break
 		}
 	}
@@ -543,6 +591,7 @@ func (r *reducer) removeSpec(spec ast.Spec) (undo func()) {
 		return func() {
 			gd.Specs = oldSpecs
 			undo()
+			undoDoc()
 		}
 	}
 	f := r.parents[gd].(*ast.File)
@@ -550,7 +599,7 @@ func (r *reducer) removeSpec(spec ast.Spec) (undo func()) {
 	if len(gd.Specs) == 0 { // remove decl too
 		for i, decl := range oldDecls {
 			if decl == gd {
-				f.Decls = append(f.Decls[:i], f.Decls[i+1:]...)
+				f.Decls = append(f.Decls[:i:i], f.Decls[i+1:]...)
 				break
 			}
 		}
@@ -558,6 +607,7 @@ func (r *reducer) removeSpec(spec ast.Spec) (undo func()) {
 	return func() {
 		gd.Specs = oldSpecs
 		f.Decls = oldDecls
+		undoDoc()
 	}
 }
 
@@ -621,8 +671,29 @@ func (r *reducer) mergeLines(start, end token.Pos) {
 	file := r.fset.File(start)
 	l1 := file.Line(start)
 	l2 := file.Line(end)
+	// directives must stay at the start of their lines
+	dirLines := make(map[int]bool)
+	for _, cg := range r.file.Comments {
+		for _, c := range cg.List {
+			if isDirective(c) && r.fset.File(c.Pos()) == file {
+				dirLines[file.Line(c.Pos())] = true
+			}
+		}
+	}
 	for l1 < l2 && l1 < file.LineCount() {
+		if dirLines[l1+1] {
+			l1++
+			continue
+		}
 		file.MergeLine(l1)
+		shifted := make(map[int]bool, len(dirLines))
+		for l := range dirLines {
+			if l > l1 {
+				l--
+			}
+			shifted[l] = true
+		}
+		dirLines = shifted
 		l1++
 	}
 }
@@ -749,10 +820,18 @@ func (r *reducer) afterDelete(nodes ...ast.Node) {
 			}
 		case *types.Var:
 			declIdent := r.revDefs[x]
+			switch r.parents[declIdent].(type) {
+			case ast.Spec, *ast.AssignStmt:
+			default:
+				continue // such as parameters, which can be unused
+			}
 			vars = append(vars, redoVar{declIdent, declIdent.Name})
 			declIdent.Name = "_"
 			r.fixAssignTokParent(declIdent)
-			undos = append(undos, r.removeDecl(declIdent))
+			// such as a, b := f(), which can only be kept as _
+			if undo := r.removeDecl(declIdent); undo != nil {
+				undos = append(undos, undo)
+			}
 		}
 	}
 	if len(undos) > 0 {
@@ -779,12 +858,17 @@ func (r *reducer) afterDelete(nodes ...ast.Node) {
 
 func (r *reducer) unusedAfterDelete(nodes ...ast.Node) (objs []types.Object) {
 	remaining := make(map[types.Object]int)
+	// objects declared within the deleted nodes go away with them
+	declared := make(map[types.Object]bool)
 	for _, node := range nodes {
 		if node == nil {
 			continue // for convenience
 		}
 		ast.Inspect(node, func(node ast.Node) bool {
 			id, _ := node.(*ast.Ident)
+			if obj := r.info.Defs[id]; id != nil && obj != nil {
+				declared[obj] = true
+			}
 			obj := r.info.Uses[id]
 			if id == nil || obj == nil {
 				return true
@@ -804,7 +888,16 @@ func (r *reducer) unusedAfterDelete(nodes ...ast.Node) (objs []types.Object) {
 			return true
 		})
 	}
-	return
+	if len(declared) == 0 {
+		return
+	}
+	outside := objs[:0]
+	for _, obj := range objs {
+		if !declared[obj] {
+			outside = append(outside, obj)
+		}
+	}
+	return outside
 }
 
 func (r *reducer) changedStmt(orig, stmt ast.Stmt) bool {
@@ -876,6 +969,10 @@ func (r *reducer) replaceStmts(old ast.Stmt, with []ast.Stmt) (undo func()) {
 func (r *reducer) replacedStmts(old ast.Stmt, with []ast.Stmt) bool {
 	undo := r.replaceStmts(old, with)
 	if r.okChange() {
+		if len(with) == 0 {
+			r.mergeLines(old.Pos(), old.End()+1)
+			return true
+		}
 		r.mergeLines(old.Pos(), with[0].Pos())
 		r.mergeLines(with[len(with)-1].End(), old.End())
 		setPos(with[0], old.Pos())
@@ -960,3 +1057,65 @@ func (r *reducer) reduceSlice(sl *ast.SliceExpr) {
 		*expr = orig
 	}
 }
+
+// dropTests tries to remove each of the test, benchmark, example and fuzz
+// functions in the test files, except those named by the -test flag. It is run
+// before any other reduction, as unrelated tests are common and expensive to
+// keep around.
+func (r *reducer) dropTests() (anyChanges bool) {
+	for _, file := range r.allFiles() {
+		fname := r.fset.Position(file.Pos()).Filename
+		if !strings.HasSuffix(fname, "_test.go") {
+			continue
+		}
+		r.file = file
+		for _, decl := range file.Decls {
+			fd, _ := decl.(*ast.FuncDecl)
+			if fd == nil || fd.Recv != nil || !isTestFunc(fd.Name.Name) {
+				continue
+			}
+			if r.testRe != nil && r.testRe.MatchString(fd.Name.Name) {
+				continue
+			}
+			orig := file.Decls
+			for i, decl := range orig {
+				if decl == fd {
+					file.Decls = append(orig[:i:i], orig[i+1:]...)
+					break
+				}
+			}
+			undoDoc := r.removeDoc(fd.Doc)
+			r.afterDelete(fd)
+			r.didChange = false
+			if r.okChange() {
+				r.mergeLines(fd.Pos(), fd.End()+1)
+				r.logChange(fd, "removed test func %s", fd.Name.Name)
+				anyChanges = true
+				r.typeCheck()
+				r.fillObjs()
+			} else {
+				file.Decls = orig
+				undoDoc()
+			}
+		}
+	}
+	r.didChange = false
+	return anyChanges
+}
+
+// isTestFunc reports whether a function name is one that go test would run,
+// such as TestFoo or Example, but not Testify.
+func isTestFunc(name string) bool {
+	for _, prefix := range [...]string{"Test", "Benchmark", "Example", "Fuzz"} {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		if rest == "" {
+			return true
+		}
+		r, _ := utf8.DecodeRuneInString(rest)
+		return !unicode.IsLower(r)
+	}
+	return false
+}
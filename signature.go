@@ -0,0 +1,170 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// volatileRe matches the parts of an error message that often change
+	// as a program is reduced, such as positions, addresses and numbers.
+	volatileRe = regexp.MustCompile(`\S*\.(?:go|s|c|h):\d+(?::\d+)?|0x[0-9a-fA-F]+|\d+`)
+	posPrefix  = regexp.MustCompile(`^\S+:\d+(?::\d+)?: `)
+
+	goroutineRe = regexp.MustCompile(`^goroutine \d+ \[.*\]:$`)
+	frameRe     = regexp.MustCompile(`^(.+?)\([^()]*\)(?: \.\.\.)?$`)
+)
+
+// setDerivedMatch runs the command on the original program, and uses the
+// signature of its failure as the regexp to match.
+func (r *reducer) setDerivedMatch() error {
+	out, _ := r.runCmd(r.shellProg)
+	expr, err := deriveMatch(out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.logOut, "derived match: %s\n", expr)
+	r.matchRe, err = regexp.Compile(expr)
+	return err
+}
+
+// deriveMatch returns a regexp matching the signature of a failure in the
+// output of a command, such as a panic message and the function it originated
+// from, or a compiler error without its position.
+func deriveMatch(out []byte) (string, error) {
+	lines := strings.Split(string(out), "\n")
+	for _, prefix := range [...]string{"internal compiler error: ", "panic: ", "fatal error: "} {
+		for _, line := range lines {
+			i := strings.Index(line, prefix)
+			if i < 0 {
+				continue
+			}
+			expr := looseQuote(line[i:])
+			if prefix == "internal compiler error: " {
+				return expr, nil
+			}
+			if frames := parseFrames(out); len(frames) > 0 {
+				expr = "(?s)" + expr + `.*\n` + regexp.QuoteMeta(frames[0]) + `\(`
+			}
+			return expr, nil
+		}
+	}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		return looseQuote(posPrefix.ReplaceAllString(line, "")), nil
+	}
+	return "", fmt.Errorf("could not derive a regexp to match from the output:\n%s",
+		string(out))
+}
+
+// looseQuote quotes a line of output as a regexp, loosening the parts that
+// tend to change as a program is reduced.
+func looseQuote(s string) string {
+	var buf bytes.Buffer
+	last := 0
+	for _, loc := range volatileRe.FindAllStringIndex(s, -1) {
+		buf.WriteString(regexp.QuoteMeta(s[last:loc[0]]))
+		switch part := s[loc[0]:loc[1]]; {
+		case strings.HasPrefix(part, "0x"):
+			buf.WriteString(`0x[0-9a-fA-F]+`)
+		case strings.Contains(part, ":"):
+			buf.WriteString(`\S*:\d+(?::\d+)?`)
+		default:
+			buf.WriteString(`\d+`)
+		}
+		last = loc[1]
+	}
+	buf.WriteString(regexp.QuoteMeta(s[last:]))
+	return buf.String()
+}
+
+// parseFrames returns the names of the functions in the traceback of the
+// goroutine that panicked or threw a fatal error, starting from the innermost
+// call. Runtime functions are skipped, as are the deferred functions that
+// recovered and repanicked, such as the ones in the testing package.
+func parseFrames(out []byte) []string {
+	var frames []string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(nil, 1<<20)
+	failed, inTrace := false, false
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case !failed:
+			failed = strings.HasPrefix(line, "panic: ") ||
+				strings.HasPrefix(line, "fatal error: ")
+		case !inTrace:
+			inTrace = goroutineRe.MatchString(line)
+		case line == "", strings.HasPrefix(line, "created by "):
+			return frames
+		case strings.HasPrefix(line, "\t"): // file position
+		default:
+			m := frameRe.FindStringSubmatch(line)
+			if m != nil && m[1] == "panic" {
+				frames = frames[:0]
+				continue
+			}
+			if m == nil || strings.HasPrefix(m[1], "runtime.") {
+				continue
+			}
+			frames = append(frames, m[1])
+		}
+	}
+	return frames
+}
+
+// checkFrames fails if the goroutine traceback in the output does not satisfy
+// the -func and -frames options.
+func (r *reducer) checkFrames(out []byte) error {
+	if r.panicFunc == "" && !r.sameFrames {
+		return nil
+	}
+	frames := parseFrames(out)
+	if len(frames) == 0 {
+		return fmt.Errorf("no goroutine traceback found:\n%s", string(out))
+	}
+	if r.panicFunc != "" && !funcMatches(frames[0], r.panicFunc) {
+		return fmt.Errorf("panic did not originate in %s, but in %s",
+			r.panicFunc, frames[0])
+	}
+	if !r.sameFrames {
+		return nil
+	}
+	if r.origFrames == nil {
+		// The first command to run is on the original program.
+		r.origFrames = frames
+		return nil
+	}
+	if strings.Join(frames, "\n") != strings.Join(r.origFrames, "\n") {
+		return fmt.Errorf("traceback frames differ from the original:\n%s",
+			strings.Join(frames, "\n"))
+	}
+	return nil
+}
+
+// funcMatches reports whether a traceback frame is for the function with the
+// given name, which may omit the package path or a prefix of it, as in "foo",
+// "main.foo" or "(*T).foo". Pointer and value receivers are told apart.
+func funcMatches(frame, name string) bool {
+	if frame == name {
+		return true
+	}
+	// The package path ends at the first dot after its last slash, as the
+	// dots in its last element are escaped.
+	slash := strings.LastIndexByte(frame, '/')
+	dot := strings.IndexByte(frame[slash+1:], '.')
+	if dot < 0 {
+		return false
+	}
+	fn := frame[slash+1+dot+1:]
+	return name == fn || strings.HasSuffix(frame, "/"+name)
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// stubDecl returns the source of a local declaration standing in for an
+// object of another package, named name. Types are written with qual, and
+// false is returned if the object cannot be stubbed.
+func stubDecl(obj types.Object, name string, qual types.Qualifier) (string, bool) {
+	var buf bytes.Buffer
+	switch x := obj.(type) {
+	case *types.Func:
+		sig := x.Type().(*types.Signature)
+		if sig.TypeParams().Len() > 0 {
+			return "", false
+		}
+		fmt.Fprintf(&buf, "func %s(", name)
+		params := sig.Params()
+		for i := 0; i < params.Len(); i++ {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			typ := params.At(i).Type()
+			if sig.Variadic() && i == params.Len()-1 {
+				buf.WriteString("...")
+				typ = typ.(*types.Slice).Elem()
+			}
+			buf.WriteString(types.TypeString(typ, qual))
+		}
+		buf.WriteString(")")
+		results := sig.Results()
+		if results.Len() == 0 {
+			buf.WriteString(" {}")
+			break
+		}
+		// blank results, so that a bare return gives zero values
+		buf.WriteString(" (")
+		for i := 0; i < results.Len(); i++ {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString("_ " + types.TypeString(results.At(i).Type(), qual))
+		}
+		buf.WriteString(") {\n\treturn\n}")
+	case *types.Var:
+		fmt.Fprintf(&buf, "var %s %s", name, types.TypeString(x.Type(), qual))
+	case *types.Const:
+		val := x.Val().ExactString()
+		if x.Val().Kind() == constant.Float && strings.Contains(val, "/") {
+			return "", false // a fraction, which would be integer division
+		}
+		fmt.Fprintf(&buf, "const %s", name)
+		if basic, _ := x.Type().(*types.Basic); basic == nil || basic.Info()&types.IsUntyped == 0 {
+			buf.WriteString(" " + types.TypeString(x.Type(), qual))
+		}
+		buf.WriteString(" = " + val)
+	case *types.TypeName:
+		named, _ := x.Type().(*types.Named)
+		if named == nil || x.IsAlias() || named.TypeParams().Len() > 0 {
+			return "", false
+		}
+		fmt.Fprintf(&buf, "type %s %s", name, types.TypeString(named.Underlying(), qual))
+	default:
+		return "", false
+	}
+	return buf.String(), true
+}
+
+// stubObjs tries to stub each object of another package used by our files.
+func (r *reducer) stubObjs() (anyChanges bool) {
+	for _, file := range r.allFiles() {
+		r.file = file
+		var sels []*ast.SelectorExpr
+		ast.Inspect(file, func(node ast.Node) bool {
+			if sel, _ := node.(*ast.SelectorExpr); sel != nil {
+				sels = append(sels, sel)
+			}
+			return true
+		})
+		for _, sel := range sels {
+			id, _ := sel.X.(*ast.Ident)
+			if id == nil || r.info.Uses[sel.Sel] == nil {
+				continue // not a selector of an imported name
+			}
+			stubbed := id.Name + "." + sel.Sel.Name
+			r.didChange = false
+			if r.stubObj(sel) {
+				r.logChange(sel, "stubbed %s", stubbed)
+				anyChanges = true
+				// the type information is stale now
+				break
+			}
+		}
+	}
+	r.didChange = false
+	return anyChanges
+}
+
+// stubObj tries to replace the uses of an object of another package in the
+// current file with a local stub, such as a func with the same signature and
+// an empty body. If the import is no longer used, it is removed too.
+func (r *reducer) stubObj(sel *ast.SelectorExpr) bool {
+	pkgID, _ := sel.X.(*ast.Ident)
+	if pkgID == nil {
+		return false
+	}
+	pkgName, _ := r.info.Uses[pkgID].(*types.PkgName)
+	obj := r.info.Uses[sel.Sel]
+	if pkgName == nil || obj == nil || r.ownPkg(obj.Pkg()) {
+		return false
+	}
+	switch pkgName.Imported().Path() {
+	case "C", "unsafe":
+		return false // not a real package
+	}
+
+	// Types can only be written with the packages imported by the file.
+	names := make(map[string]string) // path to name
+	var imp *ast.ImportSpec
+	taken := make(map[string]bool)
+	for _, spec := range fileImports(r.file) {
+		name := r.importName(spec)
+		names[importPath(spec)] = name
+		taken[name] = true
+		if name == pkgID.Name {
+			imp = spec
+		}
+	}
+	for _, file := range r.allFiles() {
+		for _, name := range topLevelNames(file) {
+			taken[name] = true
+		}
+	}
+	qualOK := true
+	qual := func(pkg *types.Package) string {
+		if r.ownPkg(pkg) {
+			return ""
+		}
+		name, ok := names[pkg.Path()]
+		if !ok {
+			qualOK = false
+		}
+		return name
+	}
+	name := uniqueName(taken, pkgID.Name+upperFirst(obj.Name()))
+	src, ok := stubDecl(obj, name, qual)
+	if !ok || !qualOK {
+		return false
+	}
+	// Parse it on its own, leaving it without positions so that none of
+	// them point at a file that does not exist. The printer places it
+	// after the last declaration of the file.
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p\n"+src, 0)
+	if err != nil {
+		return false
+	}
+	noPos := func(token.Pos) token.Pos { return token.NoPos }
+	decl := copyNode(f.Decls[0], noPos, make(map[interface{}]interface{})).(ast.Decl)
+	stillUsed := false
+	ast.Inspect(decl, func(node ast.Node) bool {
+		if sel, _ := node.(*ast.SelectorExpr); sel != nil {
+			if !ast.IsExported(sel.Sel.Name) {
+				stillUsed = true // an unexported name of another package
+				qualOK = false
+			}
+			if id, _ := sel.X.(*ast.Ident); id != nil && id.Name == pkgID.Name {
+				stillUsed = true
+			}
+		}
+		return true
+	})
+	if !qualOK {
+		return false
+	}
+
+	// Replace all the uses in the file, and see if the import is still
+	// needed by the rest of it.
+	var undos []func()
+	undo := func() {
+		for i := len(undos) - 1; i >= 0; i-- {
+			undos[i]()
+		}
+	}
+	ast.Inspect(r.file, func(node ast.Node) bool {
+		sel2, _ := node.(*ast.SelectorExpr)
+		if sel2 == nil {
+			return true
+		}
+		id, _ := sel2.X.(*ast.Ident)
+		if id == nil || r.info.Uses[id] != pkgName {
+			return true
+		}
+		if r.info.Uses[sel2.Sel] != obj {
+			stillUsed = true
+			return true
+		}
+		if ref := r.exprRef(sel2); ref != nil {
+			*ref = &ast.Ident{NamePos: sel2.Pos(), Name: name}
+			undos = append(undos, func() { *ref = sel2 })
+		} else {
+			stillUsed = true
+		}
+		return false
+	})
+	if len(undos) == 0 {
+		return false
+	}
+	if !stillUsed && imp != nil {
+		undos = append(undos, r.removeSpec(imp))
+	}
+	origDecls := r.file.Decls
+	r.file.Decls = append(r.file.Decls, decl)
+	undos = append(undos, func() { r.file.Decls = origDecls })
+	if !r.okChange() {
+		undo()
+		return false
+	}
+	r.fillParents()
+	return true
+}
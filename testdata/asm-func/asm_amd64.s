@@ -0,0 +1,12 @@
+#include "textflag.h"
+
+// add returns a+b.
+TEXT ·add(SB), NOSPLIT, $0-16
+	MOVL a+0(FP), AX
+	MOVL b+4(FP), BX
+	ADDL BX, AX
+	MOVL AX, ret+8(FP)
+	RET
+
+TEXT ·unused(SB), NOSPLIT, $0-0
+	RET
@@ -0,0 +1,5 @@
+package main
+
+func add(a, b int32) int32
+
+func unused()
@@ -0,0 +1,6 @@
+package main
+
+func main() {
+	println(add(1, 2))
+	println("unused")
+}
@@ -0,0 +1,8 @@
+//go:build foo
+
+package main
+
+func crash() {
+	a := []int{1, 2}
+	println(a[3])
+}
@@ -0,0 +1,7 @@
+package main
+
+func main() {
+	s := "unused"
+	_ = s
+	crash()
+}
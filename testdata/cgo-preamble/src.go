@@ -0,0 +1,17 @@
+package main
+
+/*
+#include <stdio.h>
+
+static int add(int a, int b) {
+	return a + b;
+}
+
+#error boom
+*/
+// #include <stdlib.h>
+import "C"
+
+func main() {
+	println(C.add(1, 2))
+}
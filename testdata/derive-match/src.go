@@ -0,0 +1,14 @@
+package main
+
+var sink []int
+
+func main() {
+	sink = append(sink, 1, 2, 3)
+	crash()
+	println("unrelated")
+}
+
+func crash() {
+	a := []int{1, 2, 3}
+	println(a[len(sink)+2])
+}
@@ -0,0 +1,12 @@
+package main
+
+import "os"
+
+func main() {
+	n := len(os.Args)
+	println("start")
+	if os.Getenv("GOREDUCE_DIFF") != "" {
+		n++
+	}
+	println(n)
+}
@@ -0,0 +1,16 @@
+package main
+
+//go:noinline
+//go:linkname foo runtime.foo
+//go:nosplit
+func foo() {}
+
+// bar is not needed.
+//
+//go:noinline
+func bar() {}
+
+func main() {
+	foo()
+	bar()
+}
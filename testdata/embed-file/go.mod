@@ -0,0 +1,3 @@
+module embedfile
+
+go 1.16
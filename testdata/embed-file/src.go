@@ -0,0 +1,19 @@
+package main
+
+import (
+	"embed"
+	_ "embed"
+)
+
+//go:embed data.txt
+var data string
+
+// other is not needed.
+//
+//go:embed assets/*.txt
+var other embed.FS
+
+func main() {
+	println(other.ReadFile("assets/other.txt"))
+	panic(data)
+}
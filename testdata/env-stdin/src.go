@@ -0,0 +1,16 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	in, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		panic(err)
+	}
+	conf, _ := ioutil.ReadFile("config.txt")
+	println("read", len(in), len(conf))
+	panic(os.Getenv("GOREDUCE_MODE") + "-" + string(in) + "-" + string(conf))
+}
@@ -0,0 +1,13 @@
+package main
+
+import "os"
+
+func main() {
+	println("unrelated")
+	if _, err := os.Stat("ran"); err != nil {
+		os.Create("ran")
+		return
+	}
+	os.Remove("ran")
+	panic("flaky")
+}
@@ -0,0 +1,9 @@
+package fuzzcorpus
+
+func parse(data []byte, n int) int {
+	if n > 3 && len(data) > 2 && data[2] == 'x' {
+		var s []int
+		return s[n]
+	}
+	return len(data)
+}
@@ -0,0 +1,18 @@
+package fuzzcorpus
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	if parse([]byte("foo"), 1) != 3 {
+		t.Fatal("wrong length")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("foo"), 1, true)
+	f.Fuzz(func(t *testing.T, data []byte, n int, b bool) {
+		if b {
+			parse(data, n)
+		}
+	})
+}
@@ -0,0 +1,9 @@
+package helper
+
+// Double doubles a number.
+func Double(n int) int { return n * 2 }
+
+// Run crashes when given too few elements.
+func Run(elems []int) {
+	println(elems[Double(2)])
+}
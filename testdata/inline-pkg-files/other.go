@@ -0,0 +1,12 @@
+package main
+
+import (
+	"fmt"
+
+	"mvdan.cc/goreduce/testdata/inline-pkg-files/helper"
+)
+
+func values() []int {
+	fmt.Println("making values")
+	return make([]int, helper.Double(1))
+}
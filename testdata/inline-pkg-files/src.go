@@ -0,0 +1,8 @@
+package main
+
+// helper has the code that crashes.
+import "mvdan.cc/goreduce/testdata/inline-pkg-files/helper"
+
+func main() {
+	helper.Run(values())
+}
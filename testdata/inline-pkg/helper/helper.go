@@ -0,0 +1,23 @@
+// Package helper does the actual work.
+package helper
+
+import "strings"
+
+const limit = 10
+
+type list []int
+
+func (l list) at(i int) int { return l[i] }
+
+func (l list) String() string { return strings.Repeat("x", len(l)) }
+
+func check(l list, n int) int {
+	return l.at(n)
+}
+
+// Run crashes when given too few elements.
+func Run(elems []int) {
+	println(check(list(elems), limit))
+}
+
+func Unused() {}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+
+	"mvdan.cc/goreduce/testdata/inline-pkg/helper"
+)
+
+func check(n int) int {
+	return n + 1
+}
+
+func main() {
+	fmt.Println(check(2))
+	helper.Run([]int{1, 2, 3})
+}
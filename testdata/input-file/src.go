@@ -0,0 +1,12 @@
+package main
+
+import "io/ioutil"
+
+func main() {
+	data, err := ioutil.ReadFile("input.txt")
+	if err != nil {
+		println("could not read input")
+		return
+	}
+	panic(string(data))
+}
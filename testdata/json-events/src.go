@@ -0,0 +1,9 @@
+package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("start")
+	var a []int
+	println(a[0])
+}
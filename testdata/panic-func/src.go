@@ -0,0 +1,12 @@
+package main
+
+func main() {
+	a := []int{1}
+	i := 0
+	println(a[i])
+	crash(a)
+}
+
+func crash(a []int) {
+	println(a[1])
+}
@@ -0,0 +1,20 @@
+package main
+
+type T struct{ a []int }
+
+func (t T) crash() {
+	println(t.a[1])
+}
+
+type U struct{ a []int }
+
+func (u *U) crash() {
+	println(u.a[2])
+}
+
+func main() {
+	u := &U{a: []int{1, 2, 3}}
+	u.crash()
+	t := T{a: []int{1}}
+	t.crash()
+}
@@ -0,0 +1,7 @@
+package main
+
+func main() {
+	var m map[string]int
+	println("unrelated")
+	m["foo"] = 1
+}
@@ -0,0 +1,12 @@
+module reducegomod // reduced by the test
+
+go 1.18 // not the go.mod of goreduce
+
+require (
+	example.com/unused v0.0.0
+	golang.org/x/sync v0.1.0 // indirect
+)
+
+replace example.com/unused => ./unused
+
+exclude example.com/other v1.2.0
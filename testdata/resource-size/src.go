@@ -0,0 +1,8 @@
+package main
+
+func main() {
+	println("unrelated")
+	for i := 0; i < 1000; i++ {
+		print("x")
+	}
+}
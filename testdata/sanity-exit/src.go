@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	sum := 0
+	for i := 0; i < 3; i++ {
+		sum += i
+	}
+	fmt.Println("sum:", sum)
+	fmt.Fprintln(os.Stderr, "bad result")
+	os.Exit(1)
+}
@@ -0,0 +1,2 @@
+#!/bin/sh
+go build -o out && exec ./out "$@"
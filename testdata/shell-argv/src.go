@@ -0,0 +1,10 @@
+package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("starting")
+	var m map[int]bool
+	m[3] = true
+	fmt.Println("done")
+}
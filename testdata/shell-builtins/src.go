@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+func main() {
+	fmt.Println("starting")
+	var m map[string]bool
+	if len(m) == 0 {
+		m["key"] = true
+	}
+	time.Sleep(time.Hour)
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	fmt.Println("args:", len(os.Args))
+	fmt.Println(strings.ToUpper(os.Args[1]))
+}
@@ -0,0 +1,15 @@
+//go:build !nope
+
+// Package main does things.
+package main
+
+// two returns two.
+func two() int {
+	// the answer
+	return 2 // always
+}
+
+/*
+main does nothing.
+*/
+func main() {}
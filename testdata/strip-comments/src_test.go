@@ -0,0 +1,9 @@
+package main
+
+import "fmt"
+
+// Example shows two.
+func Example() {
+	fmt.Println(two()) // prints 2
+	// Output: 3
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+func main() {
+	n, _ := strconv.Atoi("12")
+	parts := strings.Split("a,b", ",")
+	println(parts[n])
+}
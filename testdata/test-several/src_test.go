@@ -0,0 +1,21 @@
+package foo
+
+import "testing"
+
+func TestFoo(t *testing.T) {
+	if Foo() != 4 {
+		t.Fatal("want 4")
+	}
+}
+
+func TestBar(t *testing.T) {
+	if Bar() != "baz" {
+		t.Fatal("want baz")
+	}
+}
+
+func TestBaz(t *testing.T) {
+	if Bar() == "baz" {
+		t.Fatal("unwanted baz")
+	}
+}
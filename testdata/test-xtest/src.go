@@ -0,0 +1,9 @@
+package foo
+
+func Foo() int {
+	return 3
+}
+
+func Bar() string {
+	return "bar"
+}
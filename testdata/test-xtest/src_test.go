@@ -0,0 +1,15 @@
+package foo
+
+import "testing"
+
+func TestBar(t *testing.T) {
+	if Bar() != "bar" {
+		t.Fatal("bad bar")
+	}
+}
+
+func BenchmarkBar(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Bar()
+	}
+}
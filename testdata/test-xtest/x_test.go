@@ -0,0 +1,19 @@
+package foo_test
+
+import (
+	"fmt"
+	"testing"
+
+	"mvdan.cc/goreduce/testdata/test-xtest"
+)
+
+func TestFoo(t *testing.T) {
+	if foo.Foo() != 4 {
+		t.Fatal("want 4")
+	}
+}
+
+func ExampleFoo() {
+	fmt.Println(foo.Foo())
+	// Output: 3
+}
@@ -0,0 +1,11 @@
+package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("waiting")
+	n := 0
+	for {
+		n++
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	conf, err := ioutil.ReadFile("conf/value.txt")
+	if err != nil {
+		panic(err)
+	}
+	println("read", len(conf))
+	panic("unset=" + os.Getenv("GOREDUCE_UNSET") + " conf=" + string(conf))
+}
@@ -0,0 +1,5 @@
+module vendordep
+
+go 1.16
+
+require example.com/stack v1.0.0
@@ -0,0 +1,11 @@
+package main
+
+import "example.com/stack"
+
+func main() {
+	s := &stack.Stack{}
+	s.Push(1)
+	s.Push(2)
+	println(s.Pop(), s.Pop())
+	println(s.Pop())
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// toolchain is the Go toolchain used to build, list and type-check packages.
+type toolchain struct {
+	bin     string // go command, absolute unless it is the default "go"
+	root    string // GOROOT, if not the default
+	version string // output of "go version"
+}
+
+// findToolchain finds the toolchain whose go command is at bin, such as a
+// development build at ~/go-tip/bin/go. If bin is empty, the go command in
+// PATH is used as is.
+func findToolchain(bin string, env []string) (toolchain, error) {
+	if bin == "" {
+		tc := toolchain{bin: "go"}
+		version, err := tc.output(env, "version")
+		if err != nil {
+			return toolchain{}, err
+		}
+		tc.version = version
+		return tc, nil
+	}
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return toolchain{}, err
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return toolchain{}, err
+	}
+	tc := toolchain{bin: path}
+	// GOROOT is left out, as it would belong to another toolchain.
+	env = setEnv(env, "GOROOT", "")
+	if tc.root, err = tc.output(env, "env", "GOROOT"); err != nil {
+		return toolchain{}, err
+	}
+	if tc.version, err = tc.output(env, "version"); err != nil {
+		return toolchain{}, err
+	}
+	return tc, nil
+}
+
+func (tc toolchain) output(env []string, args ...string) (string, error) {
+	cmd := exec.Command(tc.bin, args...)
+	cmd.Env = env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go %s: %v\n%s", strings.Join(args, " "), err, stderr.Bytes())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// env returns the environment for the shell commands, so that the go command
+// in PATH is this toolchain's. It is also kept from switching to another
+// toolchain, such as one required by go.mod.
+func (tc toolchain) env(env []string) []string {
+	if tc.root == "" {
+		return env
+	}
+	env = setEnv(env, "PATH", filepath.Dir(tc.bin)+string(os.PathListSeparator)+getEnv(env, "PATH"))
+	env = setEnv(env, "GOROOT", tc.root)
+	return setEnv(env, "GOTOOLCHAIN", "local")
+}
+
+var goMinorRe = regexp.MustCompile(`\bgo1\.(\d+)`)
+
+// buildContext makes a build context select the files that this toolchain
+// would, by using its GOROOT and release tags.
+func (tc toolchain) buildContext(ctx *build.Context) {
+	if tc.root == "" {
+		return
+	}
+	ctx.GOROOT = tc.root
+	m := goMinorRe.FindStringSubmatch(tc.version)
+	if m == nil {
+		return // a development build without a version, like devel +abc
+	}
+	minor, _ := strconv.Atoi(m[1])
+	ctx.ReleaseTags = nil
+	for i := 1; i <= minor; i++ {
+		ctx.ReleaseTags = append(ctx.ReleaseTags, "go1."+strconv.Itoa(i))
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/build"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// depModule is a third-party module whose packages are copied into the
+// workspace with -deps, so that they can be inlined and reduced too.
+type depModule struct {
+	path      string
+	version   string
+	goVersion string
+}
+
+// dir returns the directory that the module is copied to, relative to the
+// workspace.
+func (m *depModule) dir() string {
+	return "_deps/" + m.path
+}
+
+// listDeps lists the third-party packages that the package in dir and its
+// tests import, directly or not, along with their modules. They are found
+// in the vendor directory if the module has one, and in the module cache
+// otherwise.
+func listDeps(bctx build.Context, mod module, dir, goBin string, env []string) ([]*build.Package, map[string]*depModule, error) {
+	args := []string{"list", "-e", "-deps", "-test", "-f",
+		"{{if and .Module (not .Module.Main)}}" +
+			"{{.ImportPath}}\t{{.Dir}}\t{{.Module.Path}}\t{{.Module.Version}}\t{{.Module.GoVersion}}" +
+			"{{end}}",
+	}
+	args = append(args, mod.listFlags()...)
+	args = append(args, ".")
+	cmd := exec.Command(goBin, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("go list: %v\n%s", err, stderr.Bytes())
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pkgs []*build.Package
+	mods := make(map[string]*depModule)
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) != 5 || strings.Contains(fields[0], " ") {
+			continue // empty line, or a test variant
+		}
+		m := mods[fields[2]]
+		if m == nil {
+			m = &depModule{path: fields[2], version: fields[3], goVersion: fields[4]}
+			mods[m.path] = m
+		}
+		bp, err := bctx.ImportDir(fields[1], 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		bp.ImportPath = fields[0]
+		if rel, err := filepath.Rel(absDir, bp.Dir); err == nil && !strings.HasPrefix(rel, "..") {
+			bp.Dir = filepath.Join(dir, rel)
+		}
+		pkgs = append(pkgs, bp)
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].ImportPath < pkgs[j].ImportPath
+	})
+	return pkgs, mods, nil
+}
+
+// listFlags returns the flags that go list needs to find the module's
+// dependencies, which is -mod=vendor if they are vendored.
+func (m module) listFlags() []string {
+	if _, err := os.Stat(filepath.Join(m.root, "vendor", "modules.txt")); err == nil {
+		return []string{"-mod=vendor"}
+	}
+	return nil
+}
+
+// copyDeps copies the third-party packages into the workspace, each module
+// with a go.mod file of its own.
+func (r *reducer) copyDeps(pkgs []*build.Package, mods map[string]*depModule) error {
+	for _, m := range mods {
+		mdir := filepath.Join(r.wdir, filepath.FromSlash(m.dir()))
+		if err := os.MkdirAll(mdir, 0777); err != nil {
+			return err
+		}
+		content := "module " + m.path + "\n"
+		if m.goVersion != "" {
+			content += "\ngo " + m.goVersion + "\n"
+		}
+		if err := ioutil.WriteFile(filepath.Join(mdir, "go.mod"), []byte(content), 0666); err != nil {
+			return err
+		}
+	}
+	for _, bp := range pkgs {
+		m := pkgModule(bp.ImportPath, mods)
+		rel := strings.TrimPrefix(bp.ImportPath, m.path)
+		dst := filepath.Join(r.wdir, filepath.FromSlash(m.dir()+rel))
+		if err := copyPackage(bp, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pkgModule returns the module providing a package, which is the one with the
+// longest path that is a prefix of the package's.
+func pkgModule(imp string, mods map[string]*depModule) *depModule {
+	var best *depModule
+	for _, m := range mods {
+		if imp != m.path && !strings.HasPrefix(imp, m.path+"/") {
+			continue
+		}
+		if best == nil || len(m.path) > len(best.path) {
+			best = m
+		}
+	}
+	return best
+}
+
+// sortedMods returns the modules sorted by path.
+func sortedMods(mods map[string]*depModule) []*depModule {
+	list := make([]*depModule, 0, len(mods))
+	for _, m := range mods {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].path < list[j].path })
+	return list
+}
+
+// reduceRequires removes the third-party modules that no package imports
+// anymore, such as after their code was inlined, from the workspace's go.mod.
+func (r *reducer) reduceRequires() (anyChanges bool) {
+	if len(r.depMods) == 0 {
+		return false
+	}
+	// Follow the imports from our files, through the packages that
+	// have not been inlined.
+	used := make(map[*depModule]bool)
+	seen := make(map[string]bool)
+	var queue []string
+	for _, file := range r.allFiles() {
+		for _, imp := range fileImports(file) {
+			queue = append(queue, importPath(imp))
+		}
+	}
+	for len(queue) > 0 {
+		imp := queue[0]
+		queue = queue[1:]
+		if seen[imp] {
+			continue
+		}
+		seen[imp] = true
+		dep := r.deps[imp]
+		if dep == nil {
+			continue
+		}
+		if dep.mod != nil {
+			used[dep.mod] = true
+		}
+		queue = append(queue, dep.bp.Imports...)
+	}
+	for _, m := range sortedMods(r.depMods) {
+		if used[m] {
+			continue
+		}
+		delete(r.depMods, m.path)
+		undo := func() {}
+		if r.mod.file != nil {
+			// the original go.mod cannot require it either
+			undo = r.mod.file.removeModule(m.path)
+		}
+		r.tries++
+		before, _ := ioutil.ReadFile(filepath.Join(r.wdir, "go.mod"))
+		err := r.writeGoMod()
+		if err == nil {
+			after, _ := ioutil.ReadFile(filepath.Join(r.wdir, "go.mod"))
+			err = r.attempt("go.mod", token.Position{}, before, after)
+		}
+		if err == nil {
+			r.logPos(token.Position{Filename: "go.mod"}, "removed requirement %s", m.path)
+			anyChanges = true
+			continue
+		}
+		r.depMods[m.path] = m
+		undo()
+		r.writeGoMod()
+	}
+	return anyChanges
+}
+
+// writeGoMod writes the workspace's go.mod file, which requires and replaces
+// the third-party modules copied into the workspace, if any.
+func (r *reducer) writeGoMod() error {
+	return r.mod.writeGoMod(r.wdir, sortedMods(r.depMods))
+}